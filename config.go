@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"time"
 
 	manager "github.com/snail007/goproxy/manager"
 	"github.com/snail007/goproxy/services"
@@ -28,6 +29,13 @@ func initConfig() (err error) {
 			utils.Keygen()
 			os.Exit(0)
 		}
+		//passwd
+		if os.Args[1] == "passwd" {
+			if utils.Passwd(os.Args[2:]) != nil {
+				os.Exit(1)
+			}
+			os.Exit(0)
+		}
 	}
 
 	//define  args
@@ -52,6 +60,21 @@ func initConfig() (err error) {
 	captainURL := envConfig.CaptainURL
 	apiKey := envConfig.APIKey
 	workerID := app.Flag("worker-id", "Worker ID UUID").String()
+	probeTarget := app.Flag("probe-target", "host:port tunneled to through each upstream by the active health probe").Default("www.google.com:443").String()
+	probeInterval := app.Flag("probe-interval", "probe every upstream every interval seconds, zero: means no probing").Default("30").Int()
+	probeTimeout := app.Flag("probe-timeout", "tcp timeout milliseconds for each step of the upstream probe").Default("5000").Int()
+	authCacheTTL := app.Flag("auth-cache-ttl", "seconds a password accepted by captain is cached, zero: means no caching").Default("300").Int()
+	offlineAuthFile := app.Flag("offline-auth-file", "encrypted file caching verified users for logins while captain is unreachable, empty: means no offline logins").Default("offline-auth.db").String()
+	offlineAuthMaxStale := app.Flag("offline-auth-max-stale", "hours a user may log in offline after its last online verification, zero: means no limit").Default("24").Int()
+	authFailWindow := app.Flag("auth-fail-window", "seconds failed logins are counted in for bans").Default("60").Int()
+	authFailIP := app.Flag("auth-fail-ip", "ban a source ip after this many failed logins within auth-fail-window, zero: means no ip bans").Default("20").Int()
+	authFailUser := app.Flag("auth-fail-user", "ban a username from every ip after this many failed logins within auth-fail-window, anyone knowing a username can lock it out, zero: means no username bans").Default("0").Int()
+	authBan := app.Flag("auth-ban", "seconds a ban for failed logins lasts, zero: means no bans").Default("600").Int()
+	usageFlushInterval := app.Flag("usage-flush-interval", "seconds between batches of data usage sent to captain").Default("10").Int()
+	usageFlushSize := app.Flag("usage-flush-size", "send a data usage batch early once this many records are pending, zero: means only on the interval").Default("1000").Int()
+	usageInterimInterval := app.Flag("usage-interim-interval", "seconds between usage reports of open connections, zero: means only when they close").Default("60").Int()
+	usageSpoolFile := app.Flag("usage-spool-file", "write-ahead file keeping data usage until captain acknowledges it, empty: means kept in memory only").Default("usage-spool.log").String()
+	authNegativeTTL := app.Flag("auth-negative-ttl", "seconds a password rejected by captain is cached, zero: means no caching").Default("30").Int()
 
 	//########http#########
 	http := app.Command("http", "proxy on http mode")
@@ -63,10 +86,14 @@ func initConfig() (err error) {
 	httpArgs.Interval = http.Flag("interval", "check domain if blocked every interval seconds").Default("10").Int()
 	httpArgs.Blocked = http.Flag("blocked", "blocked domain file , one domain each line").Default("blocked").Short('b').String()
 	httpArgs.Direct = http.Flag("direct", "direct domain file , one domain each line").Default("direct").Short('d').String()
-	httpArgs.AuthFile = http.Flag("auth-file", "http basic auth file,\"username:password\" each line in file").Short('F').String()
+	httpArgs.AuthFile = http.Flag("auth-file", "http basic auth file,\"username:password\" each line in file, password can be hashed by: proxy passwd").Short('F').String()
 	httpArgs.Auth = http.Flag("auth", "http basic auth username and password, mutiple user repeat -a ,such as: -a user1:pass1 -a user2:pass2").Short('a').Strings()
+	httpArgs.IPAuthFile = http.Flag("ip-auth-file", "ip auth file,\"cidr username\" each line in file, clients from cidr need no credentials").String()
 	httpArgs.PoolSize = http.Flag("pool-size", "conn pool size , which connect to parent proxy, zero: means turn off pool").Short('L').Default("20").Int()
+	httpArgs.UpstreamPoolSize = http.Flag("upstream-pool-size", "warm conn pool size per upstream proxy, zero: means turn off pool").Default("3").Int()
 	httpArgs.CheckParentInterval = http.Flag("check-parent-interval", "check if proxy is okay every interval seconds,zero: means no check").Short('I').Default("3").Int()
+	httpArgs.UpstreamAttempts = http.Flag("upstream-attempts", "max upstreams to try when connecting to an upstream fails").Default("3").Int()
+	httpArgs.UpstreamDeadline = http.Flag("upstream-deadline", "total milliseconds allowed for upstream connect attempts, zero: means no deadline").Default("5000").Int()
 
 	//########socks#########
 	socks := app.Command("socks", "proxy on socks5 mode")
@@ -74,13 +101,18 @@ func initConfig() (err error) {
 	socksArgs.ParentType = socks.Flag("parent-type", "parent protocol type <tls|tcp>").Default("tcp").Short('T').Enum("tls", "tcp")
 	socksArgs.Always = socks.Flag("always", "always use parent proxy").Default("false").Bool()
 	socksArgs.Timeout = socks.Flag("timeout", "tcp timeout milliseconds when connect to real server or parent proxy").Default("2000").Int()
+	socksArgs.HTTPTimeout = socks.Flag("http-timeout", "check domain if blocked , http request timeout milliseconds when connect to host").Default("3000").Int()
 	socksArgs.Interval = socks.Flag("interval", "check domain if blocked every interval seconds").Default("10").Int()
 	socksArgs.Blocked = socks.Flag("blocked", "blocked domain file , one domain each line").Default("blocked").Short('b').String()
 	socksArgs.Direct = socks.Flag("direct", "direct domain file , one domain each line").Default("direct").Short('d').String()
-	socksArgs.AuthFile = socks.Flag("auth-file", "socks5 auth file,\"username:password\" each line in file").Short('F').String()
+	socksArgs.AuthFile = socks.Flag("auth-file", "socks5 auth file,\"username:password\" each line in file, password can be hashed by: proxy passwd").Short('F').String()
 	socksArgs.Auth = socks.Flag("auth", "socks5 auth username and password, mutiple user repeat -a ,such as: -a user1:pass1 -a user2:pass2").Short('a').Strings()
+	socksArgs.IPAuthFile = socks.Flag("ip-auth-file", "ip auth file,\"cidr username\" each line in file, clients from cidr need no credentials").String()
 	socksArgs.PoolSize = socks.Flag("pool-size", "conn pool size , which connect to parent proxy, zero: means turn off pool").Short('L').Default("20").Int()
+	socksArgs.UpstreamPoolSize = socks.Flag("upstream-pool-size", "warm conn pool size per upstream proxy, zero: means turn off pool").Default("3").Int()
 	socksArgs.CheckParentInterval = socks.Flag("check-parent-interval", "check if proxy is okay every interval seconds,zero: means no check").Short('I').Default("3").Int()
+	socksArgs.UpstreamAttempts = socks.Flag("upstream-attempts", "max upstreams to try when connecting to an upstream fails").Default("3").Int()
+	socksArgs.UpstreamDeadline = socks.Flag("upstream-deadline", "total milliseconds allowed for upstream connect attempts, zero: means no deadline").Default("5000").Int()
 
 	//########tcp#########
 	tcp := app.Command("tcp", "proxy on tcp mode")
@@ -124,6 +156,21 @@ func initConfig() (err error) {
 	if captainURL != "" && *workerID != "" {
 		log.Printf("Starting Captain Client (URL: %s, WorkerID: %s)", captainURL, *workerID)
 		worker = manager.NewWorker(captainURL, *workerID, apiKey)
+		worker.Prober.Target = *probeTarget
+		worker.Prober.Interval = time.Duration(*probeInterval) * time.Second
+		worker.Prober.Timeout = *probeTimeout
+		worker.AuthCache.TTL = time.Duration(*authCacheTTL) * time.Second
+		worker.AuthCache.NegativeTTL = time.Duration(*authNegativeTTL) * time.Second
+		worker.OfflineAuth.Path = *offlineAuthFile
+		worker.AuthGuard.Window = time.Duration(*authFailWindow) * time.Second
+		worker.AuthGuard.MaxIPFailures = *authFailIP
+		worker.AuthGuard.MaxUserFailures = *authFailUser
+		worker.AuthGuard.BanDuration = time.Duration(*authBan) * time.Second
+		worker.OfflineAuth.MaxStale = time.Duration(*offlineAuthMaxStale) * time.Hour
+		worker.Usage.FlushInterval = time.Duration(*usageFlushInterval) * time.Second
+		worker.Usage.FlushSize = *usageFlushSize
+		worker.Spool.Path = *usageSpoolFile
+		worker.Meter.Interval = time.Duration(*usageInterimInterval) * time.Second
 		worker.Start()
 	} else {
 		log.Println("Captain Client not configured (missing captain-url or worker-id)")
@@ -0,0 +1,222 @@
+package manager
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	util "github.com/snail007/goproxy/utils"
+)
+
+// Reasons an authenticated user is refused, surfaced to the client and reported to Captain
+var (
+	ErrUserInactive  = errors.New("user account is not active")
+	ErrUserNotInPool = errors.New("user is not assigned to this pool")
+	ErrIPNotAllowed  = errors.New("source ip is not in the user's whitelist")
+)
+
+// UserStatusActive is the only user status allowed to connect
+const UserStatusActive = "active"
+
+const (
+	// DefaultAuthFailWindow is the sliding window failed logins are counted in
+	DefaultAuthFailWindow = time.Minute
+	// DefaultAuthFailIP bans a source ip after this many failed logins within the window
+	DefaultAuthFailIP = 20
+	// DefaultAuthFailUser bans a username after this many failed logins within the window,
+	// off by default since anyone knowing a username could lock its owner out
+	DefaultAuthFailUser = 0
+	// DefaultAuthBan is how long a ban lasts
+	DefaultAuthBan = 10 * time.Minute
+)
+
+const (
+	// DefaultAuthCacheTTL is how long a password accepted by Captain is trusted
+	DefaultAuthCacheTTL = 5 * time.Minute
+	// DefaultAuthNegativeTTL is how long a password rejected by Captain stays rejected
+	DefaultAuthNegativeTTL = 30 * time.Second
+)
+
+// AuthorizeUser checks a user that passed password authentication against the account data
+// Captain sent for it: the account must be active, assigned to this worker's pool and
+// connecting from a whitelisted address. Users unknown to Captain, e.g. from the local auth
+// file, are allowed. Pool membership is not checked before the first pool config arrived,
+// e.g. for users accepted from offline credentials while Captain is down.
+// Rejections are reported to Captain as auth_rejected events.
+func (c *Worker) AuthorizeUser(username, ip string) error {
+	item, ok := c.Users.Get(username)
+	if !ok {
+		return nil
+	}
+	user := item.(*User)
+	pool := c.CurrentPool()
+	var reason error
+	switch {
+	case !strings.EqualFold(user.Status, UserStatusActive):
+		reason = ErrUserInactive
+	case pool != nil && !user.InPool(pool):
+		reason = ErrUserNotInPool
+	case !user.AllowsIP(ip):
+		reason = ErrIPNotAllowed
+	}
+	if reason != nil {
+		c.reportAuthRejection(username, user, ip, reason)
+	}
+	return reason
+}
+
+// InPool reports whether the user is assigned to pool, matched by pool ID or tag,
+// no user is a member of a nil pool
+func (u *User) InPool(pool *Pool) bool {
+	if pool == nil {
+		return false
+	}
+	poolID := pool.PoolId.String()
+	for _, p := range u.Pools {
+		p = strings.TrimSpace(p)
+		if strings.EqualFold(p, poolID) || (pool.PoolTag != "" && strings.EqualFold(p, pool.PoolTag)) {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsIP reports whether ip matches the user's whitelist of single IPs and CIDRs,
+// an empty whitelist allows every address
+func (u *User) AllowsIP(ip string) bool {
+	if len(u.IpWhitelist) == 0 {
+		return true
+	}
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	for _, entry := range u.IpWhitelist {
+		entry = strings.TrimSpace(entry)
+		if strings.Contains(entry, "/") {
+			if _, network, err := net.ParseCIDR(entry); err == nil && network.Contains(addr) {
+				return true
+			}
+		} else if allowed := net.ParseIP(entry); allowed != nil && allowed.Equal(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// reportAuthRejection logs a refused user and tells Captain about it without blocking the caller
+func (c *Worker) reportAuthRejection(username string, user *User, ip string, reason error) {
+	log.Printf("[Auth] Rejected user %s from %s: %s", username, ip, reason)
+	rejection := AuthRejection{
+		Username: username,
+		SourceIP: ip,
+		Reason:   reason.Error(),
+		WorkerID: c.WorkerID,
+	}
+	if user != nil {
+		rejection.UserID = user.ID
+	}
+	c.notify(Event{Type: "auth_rejected", Payload: rejection})
+}
+
+// processUserUpdate replaces the account data of a user and drops its cached password check,
+// so changed passwords, statuses, whitelists and pools apply to the next connection
+func (c *Worker) processUserUpdate(payload interface{}) {
+	data, _ := json.Marshal(payload)
+	var update UserPayload
+	if err := json.Unmarshal(data, &update); err != nil {
+		log.Printf("[Captain] Failed to parse user_update: %v", err)
+		return
+	}
+	username := c.resolveUsername(update.Username, update.ID)
+	if username == "" {
+		log.Printf("[Captain] user_update for unknown user %s ignored", update.ID)
+		return
+	}
+	c.AuthCache.Delete(username)
+	c.OfflineAuth.Forget(username)
+	user := userFromPayload(update)
+	c.Users.Set(username, &user)
+	c.applyUserLimits(username, &user)
+	c.rebuildIPAuth()
+	log.Printf("[Captain] User %s updated (status: %s)", username, update.Status)
+}
+
+// processUserDelete forgets a user, its next connection is verified with Captain again
+func (c *Worker) processUserDelete(payload interface{}) {
+	data, _ := json.Marshal(payload)
+	var deleted UserPayload
+	if err := json.Unmarshal(data, &deleted); err != nil {
+		log.Printf("[Captain] Failed to parse user_delete: %v", err)
+		return
+	}
+	username := c.resolveUsername(deleted.Username, deleted.ID)
+	if username == "" {
+		log.Printf("[Captain] user_delete for unknown user %s ignored", deleted.ID)
+		return
+	}
+	c.AuthCache.Delete(username)
+	c.OfflineAuth.Forget(username)
+	c.Users.Remove(username)
+	c.Bandwidth.Remove(username)
+	c.Quota.Remove(username)
+	c.rebuildIPAuth()
+	log.Printf("[Captain] User %s deleted", username)
+}
+
+// resolveUsername returns username, or the name of the known user with id when it is empty
+func (c *Worker) resolveUsername(username string, id uuid.UUID) string {
+	if username != "" || id == uuid.Nil {
+		return username
+	}
+	for name, item := range c.Users.Items() {
+		if item.(*User).ID == id {
+			return name
+		}
+	}
+	return ""
+}
+
+// AuthenticateIP returns the ip authenticated user a connection without credentials from ip belongs to
+func (c *Worker) AuthenticateIP(ip string) (username string, ok bool) {
+	return c.IPAuth.Lookup(ip)
+}
+
+// rebuildIPAuth refreshes the ip authentication table from the IpWhitelist of ip authenticated users
+func (c *Worker) rebuildIPAuth() {
+	var entries []util.IPAuthEntry
+	for username, item := range c.Users.Items() {
+		user := item.(*User)
+		if !user.IpAuth {
+			continue
+		}
+		for _, allowed := range user.IpWhitelist {
+			network, err := util.ParseIPAuthNetwork(allowed)
+			if err != nil {
+				log.Printf("[Captain] Ignoring ip auth entry %q of %s: %v", allowed, username, err)
+				continue
+			}
+			entries = append(entries, util.IPAuthEntry{Network: network, Username: username})
+		}
+	}
+	c.IPAuth.Set(entries)
+}
+
+// reportAuthAbuse tells Captain about a source ip or username the AuthGuard banned
+func (c *Worker) reportAuthAbuse(ban util.AuthBan) {
+	abuse := AuthAbuse{
+		Kind:        ban.Kind,
+		SourceIP:    ban.SourceIP,
+		Username:    ban.Username,
+		Failures:    ban.Failures,
+		WindowSecs:  int64(c.AuthGuard.Window / time.Second),
+		BanSecs:     int64(ban.Duration / time.Second),
+		BannedUntil: time.Now().Add(ban.Duration),
+		WorkerID:    c.WorkerID,
+	}
+	c.notify(Event{Type: "auth_abuse", Payload: abuse})
+}
@@ -0,0 +1,108 @@
+package manager
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestUserAllowsIP(t *testing.T) {
+	tests := []struct {
+		name      string
+		whitelist []string
+		ip        string
+		want      bool
+	}{
+		{"empty whitelist", nil, "203.0.113.7", true},
+		{"single ip", []string{"203.0.113.7"}, "203.0.113.7", true},
+		{"other ip", []string{"203.0.113.7"}, "203.0.113.8", false},
+		{"cidr", []string{"10.0.0.0/8"}, "10.20.30.40", true},
+		{"outside cidr", []string{"10.0.0.0/8"}, "11.0.0.1", false},
+		{"spaces", []string{" 198.51.100.0/24 "}, "198.51.100.9", true},
+		{"ipv6 cidr", []string{"2001:db8::/32"}, "2001:db8::1", true},
+		{"ipv4 mapped", []string{"192.0.2.1"}, "::ffff:192.0.2.1", true},
+		{"bad entry skipped", []string{"nonsense", "192.0.2.1"}, "192.0.2.1", true},
+		{"unparsable ip", []string{"192.0.2.1"}, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := &User{IpWhitelist: tt.whitelist}
+			if got := u.AllowsIP(tt.ip); got != tt.want {
+				t.Errorf("AllowsIP(%q) = %v, want %v", tt.ip, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUserInPool(t *testing.T) {
+	pool := NewPool(uuid.New(), "residential", 0, "", nil)
+	tests := []struct {
+		name  string
+		pools []string
+		pool  *Pool
+		want  bool
+	}{
+		{"by id", []string{pool.PoolId.String()}, pool, true},
+		{"by tag", []string{"other", "Residential"}, pool, true},
+		{"not assigned", []string{"datacenter"}, pool, false},
+		{"no pools", nil, pool, false},
+		{"nil pool", []string{pool.PoolId.String()}, nil, false},
+		{"empty tag never matches", []string{""}, NewPool(uuid.New(), "", 0, "", nil), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := &User{Pools: tt.pools}
+			if got := u.InPool(tt.pool); got != tt.want {
+				t.Errorf("InPool = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAuthorizeUser(t *testing.T) {
+	pool := NewPool(uuid.New(), "residential", 0, "", nil)
+	tests := []struct {
+		name string
+		user *User
+		pool *Pool
+		ip   string
+		want error
+	}{
+		{"unknown user", nil, pool, "192.0.2.1", nil},
+		{"allowed", &User{Status: "Active", Pools: []string{"residential"}}, pool, "192.0.2.1", nil},
+		{"inactive", &User{Status: "suspended", Pools: []string{"residential"}}, pool, "192.0.2.1", ErrUserInactive},
+		{"other pool", &User{Status: "active", Pools: []string{"datacenter"}}, pool, "192.0.2.1", ErrUserNotInPool},
+		{"no pool config yet", &User{Status: "active", Pools: []string{"datacenter"}}, nil, "192.0.2.1", nil},
+		{"inactive without pool config", &User{Status: "disabled"}, nil, "192.0.2.1", ErrUserInactive},
+		{"ip not whitelisted", &User{Status: "active", Pools: []string{"residential"}, IpWhitelist: []string{"10.0.0.0/8"}}, pool, "192.0.2.1", ErrIPNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewWorker("http://127.0.0.1:1", uuid.New().String(), "key")
+			if tt.pool != nil {
+				c.pool.Store(tt.pool)
+			}
+			if tt.user != nil {
+				tt.user.ID = uuid.New()
+				c.Users.Set("alice", tt.user)
+			}
+			if err := c.AuthorizeUser("alice", tt.ip); err != tt.want {
+				t.Fatalf("AuthorizeUser = %v, want %v", err, tt.want)
+			}
+			select {
+			case event := <-c.notifications:
+				if tt.want == nil {
+					t.Fatalf("unexpected %s event", event.Type)
+				}
+				rejection := event.Payload.(AuthRejection)
+				if event.Type != "auth_rejected" || rejection.UserID != tt.user.ID || rejection.Reason != tt.want.Error() {
+					t.Errorf("event = %s %+v, want auth_rejected for the user with reason %q", event.Type, rejection, tt.want)
+				}
+			default:
+				if tt.want != nil {
+					t.Error("rejection was not reported to Captain")
+				}
+			}
+		})
+	}
+}
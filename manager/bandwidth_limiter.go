@@ -0,0 +1,94 @@
+package manager
+
+import (
+	"log"
+	"sync"
+
+	util "github.com/snail007/goproxy/utils"
+	"golang.org/x/time/rate"
+)
+
+// userBandwidth are the limiters shared by all connections of one user
+type userBandwidth struct {
+	upload   *rate.Limiter
+	download *rate.Limiter
+}
+
+// BandwidthLimiter holds one upload and one download limiter per user, so the rates Captain
+// sets for a user are split between all of its connections on this worker instead of
+// applying to each. Limiters are changed in place, open connections follow updates at once.
+type BandwidthLimiter struct {
+	users map[string]*userBandwidth
+	mu    sync.Mutex
+}
+
+// NewBandwidthLimiter creates a limiter registry without users
+func NewBandwidthLimiter() *BandwidthLimiter {
+	return &BandwidthLimiter{
+		users: make(map[string]*userBandwidth),
+	}
+}
+
+// Get returns the limiters of username, created with the given rates in bytes per second
+// when they do not exist yet. Zero or less means unlimited.
+func (b *BandwidthLimiter) Get(username string, uploadRate, downloadRate int64) (upload, download *rate.Limiter) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ub, ok := b.users[username]
+	if !ok {
+		ub = &userBandwidth{
+			upload:   util.NewSharedLimiter(float64(uploadRate)),
+			download: util.NewSharedLimiter(float64(downloadRate)),
+		}
+		b.users[username] = ub
+	}
+	return ub.upload, ub.download
+}
+
+// Update changes the rates of username if it has limiters
+func (b *BandwidthLimiter) Update(username string, uploadRate, downloadRate int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ub, ok := b.users[username]
+	if !ok || (sameRate(ub.upload, uploadRate) && sameRate(ub.download, downloadRate)) {
+		return
+	}
+	util.SetSharedLimit(ub.upload, float64(uploadRate))
+	util.SetSharedLimit(ub.download, float64(downloadRate))
+	log.Printf("[BandwidthLimiter] User %s limits updated, upload: %d B/s, download: %d B/s", username, uploadRate, downloadRate)
+}
+
+// sameRate reports whether limiter already enforces bytesPerSec
+func sameRate(limiter *rate.Limiter, bytesPerSec int64) bool {
+	if bytesPerSec <= 0 {
+		return limiter.Limit() == rate.Inf
+	}
+	return limiter.Limit() == rate.Limit(bytesPerSec)
+}
+
+// Remove drops the limiters of username, open connections keep the ones they have
+func (b *BandwidthLimiter) Remove(username string) {
+	b.mu.Lock()
+	delete(b.users, username)
+	b.mu.Unlock()
+}
+
+// UserLimiters returns the shared upload and download limiters of a user, both nil when
+// the connection is not authenticated
+func (c *Worker) UserLimiters(username string) (upload, download *rate.Limiter) {
+	if username == "" {
+		return nil, nil
+	}
+	var uploadRate, downloadRate int64
+	if item, ok := c.Users.Get(username); ok {
+		user := item.(*User)
+		uploadRate, downloadRate = user.UploadRate, user.DownloadRate
+	}
+	return c.Bandwidth.Get(username, uploadRate, downloadRate)
+}
+
+// applyUserLimits pushes fresh account data from Captain to the user's bandwidth limiters and quota
+func (c *Worker) applyUserLimits(username string, user *User) {
+	c.Bandwidth.Update(username, user.UploadRate, user.DownloadRate)
+	c.Quota.Set(username, user.QuotaRemaining)
+}
@@ -0,0 +1,54 @@
+package manager
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+	"golang.org/x/time/rate"
+)
+
+func TestBandwidthLimiterSharesLimiters(t *testing.T) {
+	b := NewBandwidthLimiter()
+	up, down := b.Get("alice", 1000, 2000)
+	if up.Limit() != 1000 || down.Limit() != 2000 {
+		t.Fatalf("limits = %v/%v, want 1000/2000", up.Limit(), down.Limit())
+	}
+	up2, down2 := b.Get("alice", 5, 5)
+	if up2 != up || down2 != down {
+		t.Fatal("second connection of alice got its own limiters")
+	}
+	if other, _ := b.Get("bob", 1000, 2000); other == up {
+		t.Fatal("bob shares the limiters of alice")
+	}
+
+	b.Update("alice", 0, 500)
+	if up.Limit() != rate.Inf || down.Limit() != 500 {
+		t.Errorf("limits after update = %v/%v, want unlimited/500", up.Limit(), down.Limit())
+	}
+	b.Update("carol", 100, 100)
+	if up3, _ := b.Get("carol", 0, 0); up3.Limit() != rate.Inf {
+		t.Error("Update created limiters for a user without connections")
+	}
+
+	b.Remove("alice")
+	if up4, _ := b.Get("alice", 1000, 2000); up4 == up {
+		t.Error("Remove kept the limiters of alice")
+	}
+}
+
+func TestWorkerUserLimiters(t *testing.T) {
+	c := NewWorker("http://127.0.0.1:1", uuid.New().String(), "key")
+	if up, down := c.UserLimiters(""); up != nil || down != nil {
+		t.Fatal("unauthenticated connection got limiters")
+	}
+	c.Users.Set("alice", &User{UploadRate: 100, DownloadRate: 200})
+	up, down := c.UserLimiters("alice")
+	if up.Limit() != 100 || down.Limit() != 200 {
+		t.Fatalf("limits = %v/%v, want 100/200 from the account", up.Limit(), down.Limit())
+	}
+
+	c.applyUserLimits("alice", &User{UploadRate: 300})
+	if up.Limit() != 300 || down.Limit() != rate.Inf {
+		t.Errorf("limits after account update = %v/%v, want 300/unlimited", up.Limit(), down.Limit())
+	}
+}
@@ -0,0 +1,203 @@
+package manager
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// BreakerState is the state of an upstream circuit breaker
+type BreakerState int
+
+const (
+	BreakerClosed BreakerState = iota
+	BreakerOpen
+	BreakerHalfOpen
+)
+
+const (
+	// breakerConsecutiveFailures opens the breaker after this many dial failures in a row
+	breakerConsecutiveFailures = 5
+	// breakerWindowSize is the number of recent results used for the error rate
+	breakerWindowSize = 20
+	// breakerMinSamples is the minimum number of results before the error rate is considered
+	breakerMinSamples = 10
+	// breakerErrorRate opens the breaker when the windowed error rate reaches it
+	breakerErrorRate = 0.5
+	// breakerCooldown is how long an open breaker rejects traffic before probing
+	breakerCooldown = 30 * time.Second
+	// breakerHalfOpenProbes is the number of concurrent probes allowed while half-open
+	breakerHalfOpenProbes = 1
+	// breakerHalfOpenSuccesses closes the breaker after this many successful probes
+	breakerHalfOpenSuccesses = 3
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// CircuitBreaker tracks dial results of one upstream and decides whether it may receive traffic.
+// A closed breaker passes all traffic. It opens on consecutive failures or a high error rate,
+// rejects traffic for a cool-down, then goes half-open and lets a few probes through
+// before closing again.
+type CircuitBreaker struct {
+	name string
+
+	mu                  sync.Mutex
+	state               BreakerState
+	consecutiveFailures int
+	window              [breakerWindowSize]bool // true marks a failure
+	windowPos           int
+	windowCount         int
+	windowFailures      int
+	openedAt            time.Time
+	probesInFlight      int
+	probeStartedAt      time.Time
+	probeSuccesses      int
+}
+
+// NewCircuitBreaker creates a closed breaker, name is only used for logging
+func NewCircuitBreaker(name string) *CircuitBreaker {
+	return &CircuitBreaker{
+		name:  name,
+		state: BreakerClosed,
+	}
+}
+
+// State returns the current breaker state
+func (b *CircuitBreaker) State() BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// Ready reports whether the breaker would let a request through right now, without reserving it
+func (b *CircuitBreaker) Ready() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.ready(time.Now())
+}
+
+func (b *CircuitBreaker) ready(now time.Time) bool {
+	switch b.state {
+	case BreakerOpen:
+		return now.Sub(b.openedAt) >= breakerCooldown
+	case BreakerHalfOpen:
+		// a probe whose result never came back must not block the upstream forever
+		return b.probesInFlight < breakerHalfOpenProbes || now.Sub(b.probeStartedAt) >= breakerCooldown
+	default:
+		return true
+	}
+}
+
+// Allow reserves a request slot, moving an open breaker to half-open once the cool-down is over
+func (b *CircuitBreaker) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	if !b.ready(now) {
+		return false
+	}
+	switch b.state {
+	case BreakerOpen:
+		b.transition(BreakerHalfOpen)
+		b.probesInFlight = 1
+		b.probeStartedAt = now
+	case BreakerHalfOpen:
+		if b.probesInFlight >= breakerHalfOpenProbes {
+			b.probesInFlight = 0
+		}
+		b.probesInFlight++
+		b.probeStartedAt = now
+	}
+	return true
+}
+
+// Record feeds the result of a dial to the upstream into the breaker
+func (b *CircuitBreaker) Record(failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case BreakerOpen:
+		// a success while open, e.g. from an active probe, starts the recovery early
+		if !failed {
+			b.transition(BreakerHalfOpen)
+			b.probeSuccesses = 1
+		}
+	case BreakerHalfOpen:
+		if b.probesInFlight > 0 {
+			b.probesInFlight--
+		}
+		if failed {
+			b.open()
+			return
+		}
+		b.probeSuccesses++
+		if b.probeSuccesses >= breakerHalfOpenSuccesses {
+			b.resetWindow()
+			b.transition(BreakerClosed)
+		}
+	case BreakerClosed:
+		b.push(failed)
+		if failed {
+			b.consecutiveFailures++
+		} else {
+			b.consecutiveFailures = 0
+		}
+		if b.consecutiveFailures >= breakerConsecutiveFailures ||
+			(b.windowCount >= breakerMinSamples && float64(b.windowFailures)/float64(b.windowCount) >= breakerErrorRate) {
+			b.open()
+		}
+	}
+}
+
+func (b *CircuitBreaker) push(failed bool) {
+	if b.windowCount == breakerWindowSize {
+		if b.window[b.windowPos] {
+			b.windowFailures--
+		}
+	} else {
+		b.windowCount++
+	}
+	b.window[b.windowPos] = failed
+	if failed {
+		b.windowFailures++
+	}
+	b.windowPos = (b.windowPos + 1) % breakerWindowSize
+}
+
+func (b *CircuitBreaker) resetWindow() {
+	b.window = [breakerWindowSize]bool{}
+	b.windowPos = 0
+	b.windowCount = 0
+	b.windowFailures = 0
+	b.consecutiveFailures = 0
+}
+
+func (b *CircuitBreaker) open() {
+	b.openedAt = time.Now()
+	b.probesInFlight = 0
+	b.probeSuccesses = 0
+	b.transition(BreakerOpen)
+}
+
+func (b *CircuitBreaker) transition(to BreakerState) {
+	if b.state == to {
+		return
+	}
+	log.Printf("[CircuitBreaker] Upstream %s: %s -> %s", b.name, b.state, to)
+	b.state = to
+	if to != BreakerHalfOpen {
+		b.probesInFlight = 0
+		b.probeSuccesses = 0
+	}
+}
@@ -0,0 +1,101 @@
+package manager
+
+import (
+	"testing"
+	"time"
+)
+
+// expire moves an open breaker's cool-down into the past
+func expire(b *CircuitBreaker) {
+	b.mu.Lock()
+	b.openedAt = b.openedAt.Add(-breakerCooldown)
+	b.mu.Unlock()
+}
+
+func TestBreakerOpensOnConsecutiveFailures(t *testing.T) {
+	b := NewCircuitBreaker("test")
+	for i := 0; i < breakerConsecutiveFailures-1; i++ {
+		b.Record(true)
+	}
+	if s := b.State(); s != BreakerClosed {
+		t.Fatalf("state after %d failures = %s, want closed", breakerConsecutiveFailures-1, s)
+	}
+	b.Record(true)
+	if s := b.State(); s != BreakerOpen {
+		t.Fatalf("state after %d failures = %s, want open", breakerConsecutiveFailures, s)
+	}
+	if b.Ready() || b.Allow() {
+		t.Fatal("open breaker let traffic through during its cool-down")
+	}
+}
+
+func TestBreakerOpensOnErrorRate(t *testing.T) {
+	b := NewCircuitBreaker("test")
+	// alternating results never reach the consecutive limit but fail half the window
+	for i := 0; i < breakerMinSamples; i++ {
+		b.Record(i%2 == 0)
+	}
+	if s := b.State(); s != BreakerOpen {
+		t.Fatalf("state at a %.0f%% error rate = %s, want open", breakerErrorRate*100, s)
+	}
+}
+
+func TestBreakerRecovers(t *testing.T) {
+	b := NewCircuitBreaker("test")
+	for i := 0; i < breakerConsecutiveFailures; i++ {
+		b.Record(true)
+	}
+	expire(b)
+	if !b.Ready() {
+		t.Fatal("breaker not ready after its cool-down")
+	}
+	if !b.Allow() {
+		t.Fatal("breaker rejected the first probe")
+	}
+	if s := b.State(); s != BreakerHalfOpen {
+		t.Fatalf("state after the cool-down = %s, want half-open", s)
+	}
+	if b.Allow() {
+		t.Fatalf("breaker allowed more than %d concurrent probes", breakerHalfOpenProbes)
+	}
+	for i := 0; i < breakerHalfOpenSuccesses; i++ {
+		if i > 0 && !b.Allow() {
+			t.Fatalf("breaker rejected probe %d", i+1)
+		}
+		b.Record(false)
+	}
+	if s := b.State(); s != BreakerClosed {
+		t.Fatalf("state after %d successful probes = %s, want closed", breakerHalfOpenSuccesses, s)
+	}
+}
+
+func TestBreakerReopensOnFailedProbe(t *testing.T) {
+	b := NewCircuitBreaker("test")
+	for i := 0; i < breakerConsecutiveFailures; i++ {
+		b.Record(true)
+	}
+	expire(b)
+	b.Allow()
+	b.Record(true)
+	if s := b.State(); s != BreakerOpen {
+		t.Fatalf("state after a failed probe = %s, want open", s)
+	}
+	if b.Ready() {
+		t.Fatal("reopened breaker ready before a new cool-down")
+	}
+}
+
+func TestBreakerStuckProbeExpires(t *testing.T) {
+	b := NewCircuitBreaker("test")
+	for i := 0; i < breakerConsecutiveFailures; i++ {
+		b.Record(true)
+	}
+	expire(b)
+	b.Allow()
+	b.mu.Lock()
+	b.probeStartedAt = time.Now().Add(-breakerCooldown)
+	b.mu.Unlock()
+	if !b.Allow() {
+		t.Fatal("a probe that never reported blocks the upstream forever")
+	}
+}
@@ -0,0 +1,84 @@
+package manager
+
+import (
+	"errors"
+	"log"
+	"sync"
+)
+
+// ErrTooManyConnections refuses a connection of a user that reached its concurrent connection limit
+var ErrTooManyConnections = errors.New("too many concurrent connections")
+
+// ConnectionLimiter counts the open connections per user
+type ConnectionLimiter struct {
+	counts map[string]int
+	mu     sync.Mutex
+}
+
+// NewConnectionLimiter creates a limiter without connections
+func NewConnectionLimiter() *ConnectionLimiter {
+	return &ConnectionLimiter{
+		counts: make(map[string]int),
+	}
+}
+
+// Acquire counts a new connection of key unless it already has limit connections,
+// a limit of zero or less means unlimited
+func (l *ConnectionLimiter) Acquire(key string, limit int) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if limit > 0 && l.counts[key] >= limit {
+		return false
+	}
+	l.counts[key]++
+	return true
+}
+
+// Release uncounts a connection of key
+func (l *ConnectionLimiter) Release(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.counts[key] <= 1 {
+		delete(l.counts, key)
+		return
+	}
+	l.counts[key]--
+}
+
+// Count returns the open connections of key
+func (l *ConnectionLimiter) Count(key string) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.counts[key]
+}
+
+// ConnectionLimit returns the maximum concurrent connections of a user, its own limit from
+// Captain or else the pool default, zero means unlimited
+func (c *Worker) ConnectionLimit(username string) int {
+	if item, ok := c.Users.Get(username); ok {
+		if limit := item.(*User).MaxConnections; limit > 0 {
+			return limit
+		}
+	}
+	if pool := c.CurrentPool(); pool != nil {
+		return pool.MaxConnectionsPerUser
+	}
+	return 0
+}
+
+// AcquireConnection counts a new connection of an authenticated user against its limit.
+// release must be called once the connection closes, calling it again does nothing.
+func (c *Worker) AcquireConnection(username string) (release func(), err error) {
+	if username == "" {
+		return func() {}, nil
+	}
+	limit := c.ConnectionLimit(username)
+	if !c.Connections.Acquire(username, limit) {
+		log.Printf("[ConnectionLimiter] User %s refused, limit of %d connections reached", username, limit)
+		return nil, ErrTooManyConnections
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() { c.Connections.Release(username) })
+	}, nil
+}
@@ -0,0 +1,95 @@
+package manager
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestConnectionLimiter(t *testing.T) {
+	l := NewConnectionLimiter()
+	for i := 0; i < 2; i++ {
+		if !l.Acquire("alice", 2) {
+			t.Fatalf("connection %d refused below the limit", i+1)
+		}
+	}
+	if l.Acquire("alice", 2) {
+		t.Fatal("connection over the limit was accepted")
+	}
+	if !l.Acquire("bob", 2) {
+		t.Fatal("limit of alice applied to bob")
+	}
+	l.Release("alice")
+	if !l.Acquire("alice", 2) {
+		t.Fatal("connection refused after one was released")
+	}
+	for i := 0; i < 10; i++ {
+		if !l.Acquire("carol", 0) {
+			t.Fatal("zero limit refused a connection")
+		}
+	}
+	for i := 0; i < 12; i++ {
+		l.Release("carol")
+	}
+	if n := l.Count("carol"); n != 0 {
+		t.Errorf("Count = %d after releasing more than acquired, want 0", n)
+	}
+}
+
+func TestWorkerConnectionLimit(t *testing.T) {
+	pool := NewPool(uuid.New(), "", 0, "", nil)
+	pool.MaxConnectionsPerUser = 3
+	tests := []struct {
+		name string
+		user *User
+		pool *Pool
+		want int
+	}{
+		{"unlimited without pool", nil, nil, 0},
+		{"pool default", nil, pool, 3},
+		{"pool default for user without limit", &User{}, pool, 3},
+		{"user limit", &User{MaxConnections: 5}, pool, 5},
+		{"user limit without pool", &User{MaxConnections: 1}, nil, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewWorker("http://127.0.0.1:1", uuid.New().String(), "key")
+			if tt.pool != nil {
+				c.pool.Store(tt.pool)
+			}
+			if tt.user != nil {
+				c.Users.Set("alice", tt.user)
+			}
+			if got := c.ConnectionLimit("alice"); got != tt.want {
+				t.Errorf("ConnectionLimit = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAcquireConnection(t *testing.T) {
+	c := NewWorker("http://127.0.0.1:1", uuid.New().String(), "key")
+	c.Users.Set("alice", &User{MaxConnections: 1})
+
+	release, err := c.AcquireConnection("alice")
+	if err != nil {
+		t.Fatalf("AcquireConnection = %v, want nil", err)
+	}
+	if _, err := c.AcquireConnection("alice"); err != ErrTooManyConnections {
+		t.Fatalf("second AcquireConnection = %v, want %v", err, ErrTooManyConnections)
+	}
+	release()
+	release()
+	if n := c.Connections.Count("alice"); n != 0 {
+		t.Fatalf("Count = %d after release, want 0", n)
+	}
+	release, err = c.AcquireConnection("alice")
+	if err != nil {
+		t.Fatalf("AcquireConnection after release = %v, want nil", err)
+	}
+	release()
+
+	if _, err := c.AcquireConnection(""); err != nil {
+		t.Errorf("AcquireConnection of an unauthenticated connection = %v, want nil", err)
+	}
+}
@@ -152,8 +152,12 @@ func (h *HealthCollector) RecordSuccess() {
 	atomic.AddUint64(&h.successCount, 1)
 }
 
-// RecordUpstreamLatency records latency for a specific upstream
+// RecordUpstreamLatency records latency for a specific upstream and feeds its circuit breaker
 func (h *HealthCollector) RecordUpstreamLatency(upstreamID uuid.UUID, upstreamTag string, latency time.Duration, isError bool) {
+	if h.upstreamMgr != nil {
+		h.upstreamMgr.ReportResult(upstreamID, latency, isError)
+	}
+
 	h.upstreamMu.Lock()
 	defer h.upstreamMu.Unlock()
 
@@ -226,6 +230,14 @@ func (h *HealthCollector) BuildWorkerHealth() WorkerHealth {
 		status = "idle"
 	}
 
+	// Circuit breaker state and last probe of the configured upstreams
+	breakers := make(map[uuid.UUID]UpstreamStatus)
+	if h.upstreamMgr != nil {
+		for _, status := range h.upstreamMgr.Statuses() {
+			breakers[status.Upstream.UpstreamID] = status
+		}
+	}
+
 	// Build upstream health
 	h.upstreamMu.Lock()
 	upstreams := make([]UpstreamHealth, 0, len(h.upstreamStats))
@@ -238,19 +250,46 @@ func (h *HealthCollector) BuildWorkerHealth() WorkerHealth {
 		}
 
 		upstreamStatus := "healthy"
-		if upstreamErrorRate > 50 {
+		if upstreamErrorRate > 80 {
+			upstreamStatus = "unhealthy"
+		} else if upstreamErrorRate > 50 {
 			upstreamStatus = "degraded"
-		} else if upstreamErrorRate > 80 {
+		}
+		status, ok := breakers[stats.UpstreamID]
+		if ok && status.Breaker != BreakerClosed {
 			upstreamStatus = "unhealthy"
 		}
 
-		upstreams = append(upstreams, UpstreamHealth{
+		health := UpstreamHealth{
 			UpstreamID:  stats.UpstreamID,
 			UpstreamTag: stats.UpstreamTag,
 			Status:      upstreamStatus,
 			Latency:     avgLatency,
 			ErrorRate:   upstreamErrorRate,
-		})
+		}
+		if ok {
+			addProbeHealth(&health, status.LastProbe)
+		}
+		upstreams = append(upstreams, health)
+	}
+	// Ejected or probed upstreams are reported even without traffic in this period
+	for id, status := range breakers {
+		if _, ok := h.upstreamStats[id]; ok || (status.Breaker == BreakerClosed && status.LastProbe == nil) {
+			continue
+		}
+		health := UpstreamHealth{
+			UpstreamID:  id,
+			UpstreamTag: status.Upstream.UpstreamTag,
+			Status:      "healthy",
+		}
+		if status.Breaker != BreakerClosed {
+			health.Status = "unhealthy"
+		}
+		addProbeHealth(&health, status.LastProbe)
+		if status.LastProbe != nil && status.LastProbe.Err != nil {
+			health.Status = "unhealthy"
+		}
+		upstreams = append(upstreams, health)
 	}
 	// Reset upstream stats after building
 	h.upstreamStats = make(map[uuid.UUID]*UpstreamStats)
@@ -270,3 +309,17 @@ func (h *HealthCollector) BuildWorkerHealth() WorkerHealth {
 		Upstreams:             upstreams,
 	}
 }
+
+// addProbeHealth copies the last active probe result into an upstream health report
+func addProbeHealth(health *UpstreamHealth, probe *ProbeResult) {
+	if probe == nil {
+		return
+	}
+	probedAt := probe.Time
+	health.LastProbeAt = &probedAt
+	health.ProbeLatency = (probe.ConnectLatency + probe.HandshakeLatency).Milliseconds()
+	health.ProbeStatus = "ok"
+	if probe.Err != nil {
+		health.ProbeStatus = "failed"
+	}
+}
@@ -1,6 +1,8 @@
 package manager
 
 import (
+	"time"
+
 	"github.com/google/uuid"
 )
 
@@ -31,6 +33,15 @@ type ConfigPayload struct {
 	PoolPort      int              `json:"pool_port"`
 	PoolSubdomain string           `json:"pool_subdomain"`
 	Upstreams     []UpstreamConfig `json:"upstreams"`
+	// SelectionStrategy is one of round_robin, weighted, random, least_connections
+	// or lowest_latency, weighted when empty
+	SelectionStrategy string `json:"selection_strategy"`
+	// IpAuthUsers are users authenticated by source ip, connections from their
+	// IpWhitelist need no credentials
+	IpAuthUsers []UserPayload `json:"ip_auth_users"`
+	// MaxConnectionsPerUser limits the concurrent connections of users without
+	// their own limit, zero means unlimited
+	MaxConnectionsPerUser int `json:"max_connections_per_user"`
 }
 
 type UpstreamConfig struct {
@@ -42,7 +53,11 @@ type UpstreamConfig struct {
 	UpstreamHost     string    `json:"upstream_host"`
 	UpstreamPort     int       `json:"upstream_port"`
 	UpstreamProvider string    `json:"upstream_provider"`
-	Weight           int       `json:"weight"`
+	// UpstreamCountry is the ISO country code of the upstream's exit, added to the config
+	// payload for country targeting. Empty, e.g. from a Captain that does not send it yet,
+	// means the country is unknown.
+	UpstreamCountry string `json:"upstream_country"`
+	Weight          int    `json:"weight"`
 }
 
 type UserPayload struct {
@@ -52,6 +67,15 @@ type UserPayload struct {
 	Status      string    `json:"status"`
 	IpWhitelist []string  `json:"ip_whitelist"`
 	Pools       []string  `json:"pools"`
+	IpAuth      bool      `json:"ip_auth"`
+	// MaxConnections limits the user's concurrent connections, zero means the pool default
+	MaxConnections int `json:"max_connections"`
+	// UploadRate and DownloadRate limit the user's bandwidth in bytes per second over all
+	// of its connections, zero means unlimited
+	UploadRate   int64 `json:"upload_rate"`
+	DownloadRate int64 `json:"download_rate"`
+	// QuotaRemaining is the user's remaining data quota in bytes, absent means unlimited
+	QuotaRemaining *int64 `json:"quota_remaining"`
 }
 
 type User struct {
@@ -59,6 +83,56 @@ type User struct {
 	Status      string
 	IpWhitelist []string
 	Pools       []string
+	// IpAuth authenticates connections from IpWhitelist without credentials
+	IpAuth bool
+	// MaxConnections limits the concurrent connections, zero means the pool default
+	MaxConnections int
+	// UploadRate and DownloadRate are bytes per second limits, zero means unlimited
+	UploadRate   int64
+	DownloadRate int64
+	// QuotaRemaining is the remaining data quota in bytes, nil means unlimited
+	QuotaRemaining *int64
+}
+
+// AuthRejection reports a user that passed password authentication but was refused
+type AuthRejection struct {
+	UserID   uuid.UUID `json:"user_id"`
+	Username string    `json:"username"`
+	SourceIP string    `json:"source_ip"`
+	Reason   string    `json:"reason"`
+	WorkerID string    `json:"worker_id"`
+}
+
+// AuthAbuse reports a source ip or username banned for too many failed logins
+type AuthAbuse struct {
+	Kind        string    `json:"kind"`
+	SourceIP    string    `json:"source_ip"`
+	Username    string    `json:"username"`
+	Failures    int       `json:"failures"`
+	WindowSecs  int64     `json:"window_secs"`
+	BanSecs     int64     `json:"ban_secs"`
+	BannedUntil time.Time `json:"banned_until"`
+	WorkerID    string    `json:"worker_id"`
+}
+
+// QuotaExhausted reports a user whose data quota ran out, its tunnels on the worker were closed
+type QuotaExhausted struct {
+	UserID   uuid.UUID `json:"user_id"`
+	Username string    `json:"username"`
+	Quota    int64     `json:"quota"`
+	Used     int64     `json:"used"`
+	Time     time.Time `json:"time"`
+	WorkerID string    `json:"worker_id"`
+}
+
+// OfflineAuthDecision reports a login decided from cached credentials while Captain was unreachable
+type OfflineAuthDecision struct {
+	UserID   uuid.UUID `json:"user_id"`
+	Username string    `json:"username"`
+	Accepted bool      `json:"accepted"`
+	Reason   string    `json:"reason,omitempty"`
+	Time     time.Time `json:"time"`
+	WorkerID uuid.UUID `json:"worker_id"`
 }
 
 // UserDataUsage tracks per-user data usage for reporting to Captain
@@ -76,6 +150,48 @@ type UserDataUsage struct {
 	DestinationHost string    `json:"destination_host"`
 	DestinationPort uint16    `json:"destination_port"`
 	StatusCode      uint16    `json:"status_code"`
+	// ConnectionID is set on the interim and final records of a connection reported while open
+	ConnectionID string `json:"connection_id,omitempty"`
+	// Final is set on the record sent when the connection closed
+	Final bool `json:"final,omitempty"`
+}
+
+// UsageRecord is the usage of the connections of one user through one pool to one
+// destination host and protocol, summed over a batch period
+type UsageRecord struct {
+	UserID          uuid.UUID `json:"user_id"`
+	Username        string    `json:"username"`
+	PoolID          uuid.UUID `json:"pool_id"`
+	PoolName        string    `json:"pool_name"`
+	Protocol        string    `json:"protocol"`
+	DestinationHost string    `json:"destination_host"`
+	BytesSent       uint64    `json:"bytes_sent"`
+	BytesReceived   uint64    `json:"bytes_received"`
+	Connections     uint64    `json:"connections"`
+	// ConnectionID is set on the records of a single connection reported while open, those
+	// are not aggregated with other connections
+	ConnectionID string `json:"connection_id,omitempty"`
+	// Final is set when the connection with ConnectionID closed during the batch period
+	Final bool `json:"final,omitempty"`
+}
+
+// UsageBatch reports the usage of the connections closed on a worker during a period
+type UsageBatch struct {
+	// Epoch is new for every worker process and Seq numbers its batches, Captain counts
+	// each (worker, epoch, seq) only once
+	Epoch        string        `json:"epoch"`
+	Seq          uint64        `json:"seq"`
+	WorkerID     uuid.UUID     `json:"worker_id"`
+	WorkerRegion string        `json:"worker_region"`
+	PeriodStart  time.Time     `json:"period_start"`
+	PeriodEnd    time.Time     `json:"period_end"`
+	Records      []UsageRecord `json:"records"`
+}
+
+// UsageAck acknowledges every usage batch of Epoch up to Seq
+type UsageAck struct {
+	Epoch string `json:"epoch"`
+	Seq   uint64 `json:"seq"`
 }
 
 // WorkerHealth represents the health status of a worker for telemetry
@@ -95,9 +211,12 @@ type WorkerHealth struct {
 
 // UpstreamHealth represents the health status of an upstream proxy
 type UpstreamHealth struct {
-	UpstreamID  uuid.UUID `json:"upstream_id"`
-	UpstreamTag string    `json:"upstream_tag"`
-	Status      string    `json:"status"`
-	Latency     int64     `json:"latency"`
-	ErrorRate   float32   `json:"error_rate"`
+	UpstreamID   uuid.UUID  `json:"upstream_id"`
+	UpstreamTag  string     `json:"upstream_tag"`
+	Status       string     `json:"status"`
+	Latency      int64      `json:"latency"`
+	ErrorRate    float32    `json:"error_rate"`
+	ProbeStatus  string     `json:"probe_status,omitempty"`
+	ProbeLatency int64      `json:"probe_latency,omitempty"`
+	LastProbeAt  *time.Time `json:"last_probe_at,omitempty"`
 }
@@ -0,0 +1,339 @@
+package manager
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	util "github.com/snail007/goproxy/utils"
+)
+
+const (
+	// DefaultOfflineAuthMaxStale is how long after its last online verification a user may
+	// still log in while Captain is unreachable
+	DefaultOfflineAuthMaxStale = 24 * time.Hour
+	// offlineAuthFlushInterval is how often changed credentials are written to disk
+	offlineAuthFlushInterval = 30 * time.Second
+	// offlineAuthMaxDecisions bounds the offline decisions kept for reporting to Captain
+	offlineAuthMaxDecisions = 10000
+)
+
+// Reasons an offline login is refused
+var (
+	ErrOfflineUnknownUser = errors.New("user was never verified online")
+	ErrOfflineStale       = errors.New("cached credentials are too old")
+	ErrOfflineBadPassword = errors.New("password does not match the cached credentials")
+)
+
+// offlineCredential is a user verified by Captain, as stored on disk
+type offlineCredential struct {
+	Salt       []byte    `json:"salt"`
+	Hash       []byte    `json:"hash"`
+	Iterations int       `json:"iterations"`
+	VerifiedAt time.Time `json:"verified_at"`
+	User       User      `json:"user"`
+}
+
+// OfflineAuth keeps the credentials of users recently verified by Captain in an encrypted
+// file, so they can still log in while Captain is unreachable. Passwords are stored as salted
+// PBKDF2 hashes and the file is sealed with AES-GCM under a key derived from the worker API key.
+// Decisions taken offline are kept until they are reported to Captain.
+type OfflineAuth struct {
+	// Path of the credential file, empty disables offline authentication
+	Path string
+	// MaxStale is how long after its last online verification a credential stays usable
+	MaxStale time.Duration
+
+	key         [32]byte
+	credentials map[string]*offlineCredential
+	decisions   []OfflineAuthDecision
+	dirty       bool
+	mu          sync.Mutex
+	stopCh      chan struct{}
+	done        chan struct{} // closed once the last changes were written
+}
+
+// NewOfflineAuth creates an offline credential store encrypted with a key derived from apiKey
+func NewOfflineAuth(path, apiKey string, maxStale time.Duration) *OfflineAuth {
+	return &OfflineAuth{
+		Path:        path,
+		MaxStale:    maxStale,
+		key:         sha256.Sum256([]byte("offline-auth:" + apiKey)),
+		credentials: make(map[string]*offlineCredential),
+		stopCh:      make(chan struct{}),
+	}
+}
+
+// Enabled reports whether a credential file is configured
+func (o *OfflineAuth) Enabled() bool {
+	return o.Path != ""
+}
+
+// Start loads the credential file and begins writing changes back periodically
+func (o *OfflineAuth) Start() {
+	if !o.Enabled() {
+		log.Println("[OfflineAuth] Offline authentication disabled")
+		return
+	}
+	if err := o.load(); err != nil {
+		log.Printf("[OfflineAuth] Failed to load %s: %v", o.Path, err)
+	} else {
+		log.Printf("[OfflineAuth] Loaded %d cached users from %s", o.Count(), o.Path)
+	}
+	o.done = make(chan struct{})
+	go func() {
+		defer close(o.done)
+		ticker := time.NewTicker(offlineAuthFlushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				o.flush()
+			case <-o.stopCh:
+				o.flush()
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the periodic flush and returns once pending changes were written
+func (o *OfflineAuth) Stop() {
+	if o.done == nil {
+		return
+	}
+	close(o.stopCh)
+	<-o.done
+}
+
+// Remember stores the credentials of a user Captain just accepted
+func (o *OfflineAuth) Remember(username, pass string, user User) {
+	if !o.Enabled() {
+		return
+	}
+	salt, sum, err := util.HashPassword(pass)
+	if err != nil {
+		log.Printf("[OfflineAuth] Failed to hash password of %s: %v", username, err)
+		return
+	}
+	o.mu.Lock()
+	o.credentials[username] = &offlineCredential{
+		Salt:       salt,
+		Hash:       sum,
+		Iterations: util.PBKDF2Iterations,
+		VerifiedAt: time.Now(),
+		User:       user,
+	}
+	o.dirty = true
+	o.mu.Unlock()
+}
+
+// Forget removes a user, e.g. after Captain rejected its password or deleted it
+func (o *OfflineAuth) Forget(username string) {
+	if !o.Enabled() {
+		return
+	}
+	o.mu.Lock()
+	if _, ok := o.credentials[username]; ok {
+		delete(o.credentials, username)
+		o.dirty = true
+	}
+	o.mu.Unlock()
+}
+
+// Verify checks user and pass against the cached credentials and records the decision
+// for reporting, it returns the cached account data when the login is accepted
+func (o *OfflineAuth) Verify(username, pass string) (user *User, err error) {
+	if !o.Enabled() {
+		return nil, ErrOfflineUnknownUser
+	}
+	o.mu.Lock()
+	cred := o.credentials[username]
+	o.mu.Unlock()
+
+	switch {
+	case cred == nil:
+		err = ErrOfflineUnknownUser
+	case o.MaxStale > 0 && time.Since(cred.VerifiedAt) > o.MaxStale:
+		err = ErrOfflineStale
+	case !util.CheckPasswordHash(pass, cred.Salt, cred.Hash, cred.Iterations):
+		err = ErrOfflineBadPassword
+	default:
+		u := cred.User
+		user = &u
+	}
+
+	decision := OfflineAuthDecision{
+		Username: username,
+		Accepted: err == nil,
+		Time:     time.Now(),
+	}
+	if cred != nil {
+		decision.UserID = cred.User.ID
+	}
+	if err != nil {
+		decision.Reason = err.Error()
+	}
+	o.mu.Lock()
+	if len(o.decisions) >= offlineAuthMaxDecisions {
+		o.decisions = o.decisions[1:]
+	}
+	o.decisions = append(o.decisions, decision)
+	o.mu.Unlock()
+	return
+}
+
+// TakeDecisions returns and clears the offline decisions not reported yet
+func (o *OfflineAuth) TakeDecisions() (decisions []OfflineAuthDecision) {
+	o.mu.Lock()
+	decisions, o.decisions = o.decisions, nil
+	o.mu.Unlock()
+	return
+}
+
+// requeueDecisions puts back decisions that could not be reported, ahead of newer ones.
+// Past offlineAuthMaxDecisions the oldest are dropped, the latest matter most to Captain
+func (o *OfflineAuth) requeueDecisions(decisions []OfflineAuthDecision) {
+	o.mu.Lock()
+	o.decisions = append(decisions, o.decisions...)
+	dropped := len(o.decisions) - offlineAuthMaxDecisions
+	if dropped > 0 {
+		o.decisions = o.decisions[dropped:]
+	}
+	o.mu.Unlock()
+	if dropped > 0 {
+		log.Printf("[OfflineAuth] Dropped %d unreported offline login decisions", dropped)
+	}
+}
+
+// Count returns the number of cached users
+func (o *OfflineAuth) Count() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return len(o.credentials)
+}
+
+func (o *OfflineAuth) load() error {
+	sealed, err := os.ReadFile(o.Path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	gcm, err := o.cipher()
+	if err != nil {
+		return err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return fmt.Errorf("file is truncated")
+	}
+	plain, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+	if err != nil {
+		return fmt.Errorf("decrypt failed, was the api key changed? %v", err)
+	}
+	credentials := make(map[string]*offlineCredential)
+	if err := json.Unmarshal(plain, &credentials); err != nil {
+		return err
+	}
+	o.mu.Lock()
+	o.credentials = credentials
+	o.mu.Unlock()
+	return nil
+}
+
+// flush writes the credentials to disk if they changed, through a temporary file so a crash
+// never leaves a half written file behind
+func (o *OfflineAuth) flush() {
+	o.mu.Lock()
+	if !o.dirty {
+		o.mu.Unlock()
+		return
+	}
+	plain, err := json.Marshal(o.credentials)
+	o.dirty = false
+	o.mu.Unlock()
+	if err != nil {
+		log.Printf("[OfflineAuth] Failed to encode credentials: %v", err)
+		return
+	}
+
+	gcm, err := o.cipher()
+	if err != nil {
+		log.Printf("[OfflineAuth] Failed to init cipher: %v", err)
+		return
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		log.Printf("[OfflineAuth] Failed to generate nonce: %v", err)
+		return
+	}
+	sealed := gcm.Seal(nonce, nonce, plain, nil)
+
+	tmp := o.Path + ".tmp"
+	if err := os.WriteFile(tmp, sealed, 0600); err != nil {
+		log.Printf("[OfflineAuth] Failed to write %s: %v", tmp, err)
+		o.markDirty()
+		return
+	}
+	if err := os.Rename(tmp, o.Path); err != nil {
+		log.Printf("[OfflineAuth] Failed to replace %s: %v", o.Path, err)
+		o.markDirty()
+	}
+}
+
+func (o *OfflineAuth) markDirty() {
+	o.mu.Lock()
+	o.dirty = true
+	o.mu.Unlock()
+}
+
+func (o *OfflineAuth) cipher() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(o.key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// userFromPayload converts Captain's account data to a User
+func userFromPayload(p UserPayload) User {
+	return User{
+		ID:             p.ID,
+		Status:         p.Status,
+		IpWhitelist:    p.IpWhitelist,
+		Pools:          p.Pools,
+		IpAuth:         p.IpAuth,
+		MaxConnections: p.MaxConnections,
+		UploadRate:     p.UploadRate,
+		DownloadRate:   p.DownloadRate,
+		QuotaRemaining: p.QuotaRemaining,
+	}
+}
+
+// reportOfflineDecisions sends the logins decided while Captain was unreachable
+func (c *Worker) reportOfflineDecisions() {
+	decisions := c.OfflineAuth.TakeDecisions()
+	if len(decisions) == 0 {
+		return
+	}
+	workerID, _ := uuid.Parse(c.WorkerID)
+	for i := range decisions {
+		decisions[i].WorkerID = workerID
+	}
+	if !c.send(Event{Type: "offline_auth_report", Payload: decisions}) {
+		c.OfflineAuth.requeueDecisions(decisions)
+		return
+	}
+	log.Printf("[OfflineAuth] Reported %d offline login decisions", len(decisions))
+}
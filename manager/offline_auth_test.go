@@ -0,0 +1,137 @@
+package manager
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestOfflineAuthSurvivesRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "offline.json")
+	user := User{ID: uuid.New(), Status: UserStatusActive, Pools: []string{"residential"}, UploadRate: 1024}
+
+	o := NewOfflineAuth(path, "key", time.Hour)
+	o.Start()
+	o.Remember("alice", "secret", user)
+	o.Stop()
+
+	tests := []struct {
+		name    string
+		apiKey  string
+		pass    string
+		wantErr error
+	}{
+		{"accepted", "key", "secret", nil},
+		{"wrong password", "key", "guess", ErrOfflineBadPassword},
+		{"other api key cannot decrypt", "other", "secret", ErrOfflineUnknownUser},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reloaded := NewOfflineAuth(path, tt.apiKey, time.Hour)
+			reloaded.Start()
+			defer reloaded.Stop()
+			got, err := reloaded.Verify("alice", tt.pass)
+			if err != tt.wantErr {
+				t.Fatalf("Verify = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && (got.ID != user.ID || got.UploadRate != user.UploadRate || len(got.Pools) != 1) {
+				t.Errorf("Verify returned %+v, want the remembered account %+v", got, user)
+			}
+		})
+	}
+}
+
+func TestOfflineAuthVerify(t *testing.T) {
+	o := NewOfflineAuth(filepath.Join(t.TempDir(), "offline.json"), "key", time.Hour)
+	o.Remember("alice", "secret", User{ID: uuid.New(), Status: UserStatusActive})
+	o.Remember("bob", "secret", User{ID: uuid.New(), Status: UserStatusActive})
+	o.credentials["bob"].VerifiedAt = time.Now().Add(-2 * time.Hour)
+	o.Remember("carol", "secret", User{ID: uuid.New(), Status: UserStatusActive})
+	o.Forget("carol")
+
+	tests := []struct {
+		username string
+		pass     string
+		want     error
+	}{
+		{"alice", "secret", nil},
+		{"alice", "wrong", ErrOfflineBadPassword},
+		{"bob", "secret", ErrOfflineStale},
+		{"carol", "secret", ErrOfflineUnknownUser},
+		{"dave", "secret", ErrOfflineUnknownUser},
+	}
+	for _, tt := range tests {
+		if _, err := o.Verify(tt.username, tt.pass); err != tt.want {
+			t.Errorf("Verify(%s, %s) = %v, want %v", tt.username, tt.pass, err, tt.want)
+		}
+	}
+
+	decisions := o.TakeDecisions()
+	if len(decisions) != len(tests) {
+		t.Fatalf("got %d decisions, want %d", len(decisions), len(tests))
+	}
+	for i, d := range decisions {
+		if d.Username != tests[i].username || d.Accepted != (tests[i].want == nil) {
+			t.Errorf("decision %d = %+v, want %s accepted=%v", i, d, tests[i].username, tests[i].want == nil)
+		}
+	}
+	if len(o.TakeDecisions()) != 0 {
+		t.Error("TakeDecisions did not clear the decisions")
+	}
+}
+
+func TestOfflineAuthDisabled(t *testing.T) {
+	o := NewOfflineAuth("", "key", time.Hour)
+	o.Start()
+	o.Remember("alice", "secret", User{Status: UserStatusActive})
+	if _, err := o.Verify("alice", "secret"); err != ErrOfflineUnknownUser {
+		t.Errorf("Verify = %v, want %v without a credential file", err, ErrOfflineUnknownUser)
+	}
+	o.Stop()
+}
+
+func TestOfflineAuthRequeueKeepsNewest(t *testing.T) {
+	o := NewOfflineAuth("", "key", time.Hour)
+	decision := func(i int) OfflineAuthDecision {
+		return OfflineAuthDecision{Username: "user", Time: time.Unix(int64(i), 0)}
+	}
+	for i := 0; i < 10; i++ {
+		o.decisions = append(o.decisions, decision(offlineAuthMaxDecisions+i))
+	}
+	failed := make([]OfflineAuthDecision, offlineAuthMaxDecisions)
+	for i := range failed {
+		failed[i] = decision(i)
+	}
+	o.requeueDecisions(failed)
+
+	decisions := o.TakeDecisions()
+	if len(decisions) != offlineAuthMaxDecisions {
+		t.Fatalf("kept %d decisions, want %d", len(decisions), offlineAuthMaxDecisions)
+	}
+	if first := decisions[0].Time.Unix(); first != 10 {
+		t.Errorf("oldest kept decision is %d, want 10", first)
+	}
+	if last := decisions[len(decisions)-1].Time.Unix(); last != offlineAuthMaxDecisions+9 {
+		t.Errorf("newest kept decision is %d, want %d", last, offlineAuthMaxDecisions+9)
+	}
+}
+
+func TestVerifyOfflineAppliesCachedAccount(t *testing.T) {
+	c := NewWorker("http://127.0.0.1:1", uuid.New().String(), "key")
+	c.OfflineAuth = NewOfflineAuth(filepath.Join(t.TempDir(), "offline.json"), "key", time.Hour)
+	user := User{ID: uuid.New(), Status: UserStatusActive, Pools: []string{"residential"}}
+	c.OfflineAuth.Remember("alice", "secret", user)
+
+	if c.verifyOffline("alice", "wrong") {
+		t.Fatal("verifyOffline accepted a wrong password")
+	}
+	if !c.verifyOffline("alice", "secret") {
+		t.Fatal("verifyOffline refused the cached password")
+	}
+	// before Captain's first config there is no pool to check the user against
+	if err := c.AuthorizeUser("alice", "192.0.2.1"); err != nil {
+		t.Errorf("AuthorizeUser = %v, want users accepted offline to pass before the pool config", err)
+	}
+}
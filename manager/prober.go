@@ -0,0 +1,104 @@
+package manager
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	util "github.com/snail007/goproxy/utils"
+)
+
+// ProbeResult is the outcome of the last active probe of an upstream
+type ProbeResult struct {
+	Time             time.Time
+	ConnectLatency   time.Duration
+	HandshakeLatency time.Duration
+	Err              error
+}
+
+// UpstreamProber periodically dials every configured upstream and opens an authenticated
+// tunnel to Target through it, so broken upstreams are found before a customer request fails.
+// Results feed the upstream's circuit breaker and latency average in the UpstreamManager.
+type UpstreamProber struct {
+	// Target is the host:port tunneled to through each upstream
+	Target string
+	// Interval between probe rounds, zero disables probing
+	Interval time.Duration
+	// Timeout in milliseconds for the connect and for the handshake
+	Timeout int
+
+	upstreamMgr *UpstreamManager
+	stopCh      chan struct{}
+}
+
+// NewUpstreamProber creates a prober for the upstreams of upstreamMgr
+func NewUpstreamProber(upstreamMgr *UpstreamManager, target string, interval time.Duration, timeout int) *UpstreamProber {
+	return &UpstreamProber{
+		Target:      target,
+		Interval:    interval,
+		Timeout:     timeout,
+		upstreamMgr: upstreamMgr,
+		stopCh:      make(chan struct{}),
+	}
+}
+
+// Start begins periodic probing, it does nothing when Interval or Target is not set
+func (p *UpstreamProber) Start() {
+	if p.Interval <= 0 || p.Target == "" {
+		log.Println("[UpstreamProber] Active probing disabled")
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(p.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.ProbeAll()
+			case <-p.stopCh:
+				return
+			}
+		}
+	}()
+	log.Printf("[UpstreamProber] Started, target: %s, interval: %s", p.Target, p.Interval)
+}
+
+// Stop stops periodic probing
+func (p *UpstreamProber) Stop() {
+	close(p.stopCh)
+}
+
+// ProbeAll probes every configured upstream concurrently and records the results
+func (p *UpstreamProber) ProbeAll() {
+	statuses := p.upstreamMgr.Statuses()
+	var wg sync.WaitGroup
+	for _, status := range statuses {
+		wg.Add(1)
+		go func(u Upstream) {
+			defer wg.Done()
+			result := p.Probe(&u)
+			p.upstreamMgr.RecordProbe(u.UpstreamID, result)
+			if result.Err != nil {
+				log.Printf("[UpstreamProber] Upstream %s (tag: %s) probe failed: %s", u.GetAddress(), u.UpstreamTag, result.Err)
+			}
+		}(status.Upstream)
+	}
+	wg.Wait()
+}
+
+// Probe dials an upstream and opens a tunnel to Target through it
+func (p *UpstreamProber) Probe(u *Upstream) (result ProbeResult) {
+	result.Time = time.Now()
+	conn, err := u.Dial(p.Timeout)
+	result.ConnectLatency = time.Since(result.Time)
+	if err != nil {
+		result.Err = err
+		return
+	}
+	defer util.CloseConn(&conn)
+
+	handshakeStart := time.Now()
+	result.Err = u.Tunnel(conn, p.Target, p.Timeout)
+	result.HandshakeLatency = time.Since(handshakeStart)
+	return
+}
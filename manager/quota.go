@@ -0,0 +1,204 @@
+package manager
+
+import (
+	"errors"
+	"io"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrQuotaExhausted refuses a connection of a user without remaining data quota
+var ErrQuotaExhausted = errors.New("data quota exhausted")
+
+// UserQuota counts the bytes one user transferred against the remaining quota Captain
+// last sent for it, and closes the user's open tunnels once the quota is used up.
+// Captain's remaining quota only covers usage it acknowledged, so the count holds the
+// bytes Captain has not acknowledged yet, from open tunnels, pending batches and spooled
+// ones. It is kept across Captain's updates and shrinks as usage batches are acknowledged.
+type UserQuota struct {
+	username  string
+	limited   int32 // 1 when Captain set a quota
+	remaining int64
+	used      int64 // bytes not acknowledged by Captain yet
+	exhausted int32 // 1 once used reached remaining, set only by the first to notice
+
+	tracker *QuotaTracker
+	mu      sync.Mutex
+	nextID  uint64
+	conns   map[uint64]io.Closer
+}
+
+// QuotaTracker holds the quota of every user with connections on this worker
+type QuotaTracker struct {
+	// OnExhausted, when set, is called once each time a user's quota is used up
+	OnExhausted func(username string, quota, used int64)
+
+	users map[string]*UserQuota
+	mu    sync.Mutex
+}
+
+// NewQuotaTracker creates a tracker without users
+func NewQuotaTracker() *QuotaTracker {
+	return &QuotaTracker{
+		users: make(map[string]*UserQuota),
+	}
+}
+
+// Get returns the quota of username, unlimited until Captain sets one
+func (t *QuotaTracker) Get(username string) *UserQuota {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	q, ok := t.users[username]
+	if !ok {
+		q = &UserQuota{
+			username: username,
+			tracker:  t,
+			conns:    make(map[uint64]io.Closer),
+		}
+		t.users[username] = q
+	}
+	return q
+}
+
+// Set applies the remaining quota Captain sent for username, nil means unlimited
+func (t *QuotaTracker) Set(username string, remaining *int64) {
+	t.Get(username).set(remaining)
+}
+
+// Init sets the quota of username only if it is not tracked yet, e.g. from cached data
+func (t *QuotaTracker) Init(username string, remaining *int64) {
+	t.mu.Lock()
+	_, ok := t.users[username]
+	t.mu.Unlock()
+	if !ok {
+		t.Set(username, remaining)
+	}
+}
+
+// Acknowledge uncounts n bytes of username that Captain acknowledged, they are part of the
+// next remaining quota it sends
+func (t *QuotaTracker) Acknowledge(username string, n int64) {
+	t.mu.Lock()
+	q, ok := t.users[username]
+	t.mu.Unlock()
+	if !ok {
+		return
+	}
+	for {
+		used := atomic.LoadInt64(&q.used)
+		left := used - n
+		if left < 0 {
+			left = 0
+		}
+		if atomic.CompareAndSwapInt64(&q.used, used, left) {
+			return
+		}
+	}
+}
+
+// Remove stops tracking username, open tunnels keep counting against the removed quota
+func (t *QuotaTracker) Remove(username string) {
+	t.mu.Lock()
+	delete(t.users, username)
+	t.mu.Unlock()
+}
+
+func (q *UserQuota) set(remaining *int64) {
+	if remaining == nil {
+		atomic.StoreInt32(&q.limited, 0)
+		atomic.StoreInt32(&q.exhausted, 0)
+		return
+	}
+	atomic.StoreInt64(&q.remaining, *remaining)
+	atomic.StoreInt32(&q.limited, 1)
+	if atomic.LoadInt64(&q.used) < *remaining {
+		atomic.StoreInt32(&q.exhausted, 0)
+		return
+	}
+	// when Captain sent no quota left it already knows, only the tunnels need closing
+	q.exhaust(*remaining > 0)
+}
+
+// Allowed reports whether the user may open a new connection
+func (q *UserQuota) Allowed() bool {
+	if atomic.LoadInt32(&q.limited) == 0 {
+		return true
+	}
+	return atomic.LoadInt32(&q.exhausted) == 0 && atomic.LoadInt64(&q.used) < atomic.LoadInt64(&q.remaining)
+}
+
+// Add counts n transferred bytes, closing the user's tunnels when the quota runs out
+func (q *UserQuota) Add(n int) {
+	if atomic.LoadInt32(&q.limited) == 0 {
+		return
+	}
+	if atomic.AddInt64(&q.used, int64(n)) >= atomic.LoadInt64(&q.remaining) {
+		q.exhaust(true)
+	}
+}
+
+// Register adds a connection to close when the quota runs out, unregister must be called
+// once it is closed
+func (q *UserQuota) Register(conn io.Closer) (unregister func()) {
+	q.mu.Lock()
+	q.nextID++
+	id := q.nextID
+	q.conns[id] = conn
+	q.mu.Unlock()
+	return func() {
+		q.mu.Lock()
+		delete(q.conns, id)
+		q.mu.Unlock()
+	}
+}
+
+func (q *UserQuota) exhaust(report bool) {
+	if !atomic.CompareAndSwapInt32(&q.exhausted, 0, 1) {
+		return
+	}
+	quota, used := atomic.LoadInt64(&q.remaining), atomic.LoadInt64(&q.used)
+	q.mu.Lock()
+	conns := make([]io.Closer, 0, len(q.conns))
+	for _, conn := range q.conns {
+		conns = append(conns, conn)
+	}
+	q.mu.Unlock()
+	for _, conn := range conns {
+		conn.Close()
+	}
+	log.Printf("[Quota] User %s exhausted its quota of %d bytes, closed %d tunnels", q.username, quota, len(conns))
+	if report && q.tracker.OnExhausted != nil {
+		q.tracker.OnExhausted(q.username, quota, used)
+	}
+}
+
+// CheckQuota returns the quota of an authenticated user, or ErrQuotaExhausted when it may not
+// open a new connection. It returns nil for connections that are not authenticated.
+func (c *Worker) CheckQuota(username string) (*UserQuota, error) {
+	if username == "" {
+		return nil, nil
+	}
+	q := c.Quota.Get(username)
+	if !q.Allowed() {
+		log.Printf("[Quota] User %s refused, quota exhausted", username)
+		return nil, ErrQuotaExhausted
+	}
+	return q, nil
+}
+
+// reportQuotaExhausted tells Captain a user used up its quota on this worker
+func (c *Worker) reportQuotaExhausted(username string, quota, used int64) {
+	exhausted := QuotaExhausted{
+		Username: username,
+		Quota:    quota,
+		Used:     used,
+		Time:     time.Now(),
+		WorkerID: c.WorkerID,
+	}
+	if item, ok := c.Users.Get(username); ok {
+		exhausted.UserID = item.(*User).ID
+	}
+	c.notify(Event{Type: "quota_exhausted", Payload: exhausted})
+}
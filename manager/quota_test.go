@@ -0,0 +1,126 @@
+package manager
+
+import (
+	"sync/atomic"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+// closeCounter counts how often a tunnel was closed
+type closeCounter struct {
+	closed int32
+}
+
+func (c *closeCounter) Close() error {
+	atomic.AddInt32(&c.closed, 1)
+	return nil
+}
+
+func quota(n int64) *int64 {
+	return &n
+}
+
+func TestUserQuotaExhaustion(t *testing.T) {
+	tracker := NewQuotaTracker()
+	var reports []int64
+	tracker.OnExhausted = func(username string, quota, used int64) {
+		reports = append(reports, used)
+	}
+	tracker.Set("alice", quota(100))
+	q := tracker.Get("alice")
+
+	open, closed := &closeCounter{}, &closeCounter{}
+	q.Register(open)
+	unregister := q.Register(closed)
+	unregister()
+
+	q.Add(60)
+	if !q.Allowed() || open.closed != 0 {
+		t.Fatal("quota cut off before it was used up")
+	}
+	q.Add(40)
+	if q.Allowed() {
+		t.Error("Allowed = true after the quota was used up")
+	}
+	q.Add(10)
+	if open.closed != 1 || closed.closed != 0 {
+		t.Errorf("closed %d registered and %d unregistered tunnels, want 1 and 0", open.closed, closed.closed)
+	}
+	if len(reports) != 1 || reports[0] != 100 {
+		t.Errorf("OnExhausted reports = %v, want one with 100 bytes used", reports)
+	}
+}
+
+func TestQuotaTrackerSetKeepsUnacknowledgedUsage(t *testing.T) {
+	tests := []struct {
+		name        string
+		used        int64
+		ack         int64
+		remaining   *int64
+		wantAllowed bool
+	}{
+		{"unlimited", 500, 0, nil, true},
+		{"usage below new quota", 50, 0, quota(100), true},
+		{"unacknowledged usage counts", 150, 0, quota(100), false},
+		{"acknowledged usage is in the new quota", 150, 100, quota(100), true},
+		{"acknowledge clamps at zero", 50, 100, quota(10), true},
+		{"no quota left", 0, 0, quota(0), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tracker := NewQuotaTracker()
+			reported := 0
+			tracker.OnExhausted = func(string, int64, int64) { reported++ }
+			tracker.Set("alice", quota(1000))
+			q := tracker.Get("alice")
+			q.Add(int(tt.used))
+			tracker.Acknowledge("alice", tt.ack)
+			tracker.Set("alice", tt.remaining)
+			if got := q.Allowed(); got != tt.wantAllowed {
+				t.Errorf("Allowed = %v, want %v", got, tt.wantAllowed)
+			}
+			if tt.remaining != nil && *tt.remaining == 0 && reported != 0 {
+				t.Error("a quota Captain already sent as used up was reported back")
+			}
+		})
+	}
+}
+
+func TestQuotaTrackerInit(t *testing.T) {
+	tracker := NewQuotaTracker()
+	tracker.Set("alice", quota(10))
+	tracker.Init("alice", nil)
+	if q := tracker.Get("alice"); !q.Allowed() || atomic.LoadInt32(&q.limited) != 1 {
+		t.Error("Init replaced the quota of a tracked user")
+	}
+	tracker.Init("bob", quota(0))
+	if tracker.Get("bob").Allowed() {
+		t.Error("Init did not set the quota of an untracked user")
+	}
+}
+
+func TestWorkerCheckQuota(t *testing.T) {
+	c := NewWorker("http://127.0.0.1:1", uuid.New().String(), "key")
+	if q, err := c.CheckQuota(""); q != nil || err != nil {
+		t.Fatalf("CheckQuota of an unauthenticated connection = %v, %v, want nil, nil", q, err)
+	}
+	c.Users.Set("alice", &User{ID: uuid.New()})
+	c.applyUserLimits("alice", &User{QuotaRemaining: quota(10)})
+	q, err := c.CheckQuota("alice")
+	if err != nil {
+		t.Fatalf("CheckQuota = %v, want nil", err)
+	}
+	q.Add(10)
+	if _, err := c.CheckQuota("alice"); err != ErrQuotaExhausted {
+		t.Fatalf("CheckQuota = %v, want %v", err, ErrQuotaExhausted)
+	}
+	select {
+	case event := <-c.notifications:
+		if event.Type != "quota_exhausted" || event.Payload.(QuotaExhausted).Used != 10 {
+			t.Errorf("event = %s %+v, want quota_exhausted with 10 bytes used", event.Type, event.Payload)
+		}
+	default:
+		t.Error("exhausted quota was not reported to Captain")
+	}
+}
@@ -0,0 +1,121 @@
+package manager
+
+import (
+	"log"
+	"math/rand"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Upstream selection strategies, chosen per pool by ConfigPayload.SelectionStrategy
+const (
+	StrategyRoundRobin       = "round_robin"
+	StrategyWeighted         = "weighted"
+	StrategyRandom           = "random"
+	StrategyLeastConnections = "least_connections"
+	StrategyLowestLatency    = "lowest_latency"
+)
+
+const (
+	// latencyEWMAAlpha is the weight of a new sample in the latency moving average
+	latencyEWMAAlpha = 0.3
+	// latencyFailurePenalty is the latency sample a failed dial counts as at least, so
+	// upstreams that keep failing lose lowest latency selection
+	latencyFailurePenalty = 10 * time.Second
+)
+
+// selector picks one upstream out of the eligible candidates. Candidates are enabled, healthy
+// and accepted by the caller's filter, and the list is never empty.
+// It is called with the UpstreamManager locked.
+type selector interface {
+	Select(candidates []*upstreamState) *upstreamState
+}
+
+// newSelector returns the selector for a strategy name, weighted round-robin when it is unknown
+func newSelector(strategy string) (s selector, name string) {
+	switch strings.ToLower(strings.TrimSpace(strategy)) {
+	case StrategyRoundRobin:
+		return &roundRobinSelector{}, StrategyRoundRobin
+	case StrategyRandom:
+		return randomSelector{}, StrategyRandom
+	case StrategyLeastConnections:
+		return &leastConnectionsSelector{}, StrategyLeastConnections
+	case StrategyLowestLatency:
+		return lowestLatencySelector{}, StrategyLowestLatency
+	case StrategyWeighted, "":
+		return weightedSelector{}, StrategyWeighted
+	default:
+		log.Printf("[UpstreamManager] Unknown selection strategy %q, using %s", strategy, StrategyWeighted)
+		return weightedSelector{}, StrategyWeighted
+	}
+}
+
+// roundRobinSelector rotates through the candidates ignoring weights
+type roundRobinSelector struct {
+	index uint64
+}
+
+func (s *roundRobinSelector) Select(candidates []*upstreamState) *upstreamState {
+	idx := s.index % uint64(len(candidates))
+	s.index++
+	return candidates[idx]
+}
+
+// weightedSelector is nginx-style smooth weighted round-robin
+type weightedSelector struct{}
+
+func (weightedSelector) Select(candidates []*upstreamState) *upstreamState {
+	var best *upstreamState
+	total := 0
+	for _, state := range candidates {
+		state.currentWeight += state.upstream.Weight
+		total += state.upstream.Weight
+		if best == nil || state.currentWeight > best.currentWeight {
+			best = state
+		}
+	}
+	best.currentWeight -= total
+	return best
+}
+
+// randomSelector picks a uniformly random candidate
+type randomSelector struct{}
+
+func (randomSelector) Select(candidates []*upstreamState) *upstreamState {
+	return candidates[rand.Intn(len(candidates))]
+}
+
+// leastConnectionsSelector picks the candidate with the fewest active connections,
+// rotating the starting point so ties are spread evenly
+type leastConnectionsSelector struct {
+	offset int
+}
+
+func (s *leastConnectionsSelector) Select(candidates []*upstreamState) *upstreamState {
+	s.offset = (s.offset + 1) % len(candidates)
+	var best *upstreamState
+	var bestActive int64
+	for i := range candidates {
+		state := candidates[(s.offset+i)%len(candidates)]
+		active := atomic.LoadInt64(&state.activeConnections)
+		if best == nil || active < bestActive {
+			best, bestActive = state, active
+		}
+	}
+	return best
+}
+
+// lowestLatencySelector picks the candidate with the lowest moving average connect latency.
+// Upstreams without a sample yet are tried first so every upstream gets measured
+type lowestLatencySelector struct{}
+
+func (lowestLatencySelector) Select(candidates []*upstreamState) *upstreamState {
+	var best *upstreamState
+	for _, state := range candidates {
+		if best == nil || state.latencyEWMA < best.latencyEWMA {
+			best = state
+		}
+	}
+	return best
+}
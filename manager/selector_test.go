@@ -0,0 +1,85 @@
+package manager
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSelectionStrategies(t *testing.T) {
+	tests := []struct {
+		strategy string
+		weights  []int
+		picks    int
+		// want is how often each upstream is picked, nil when the picks are random
+		want []int
+	}{
+		{StrategyRoundRobin, []int{5, 1, 1}, 6, []int{2, 2, 2}},
+		{StrategyWeighted, []int{2, 1}, 6, []int{4, 2}},
+		{"unknown", []int{2, 1}, 6, []int{4, 2}},
+		{StrategyLeastConnections, []int{1, 1, 1}, 6, []int{2, 2, 2}},
+		{StrategyRandom, []int{1, 1}, 20, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.strategy, func(t *testing.T) {
+			m := NewUpstreamManager()
+			m.SetStrategy(tt.strategy)
+			upstreams := testUpstreams(tt.weights...)
+			m.SetUpstreams(upstreams)
+			counts := make([]int, len(upstreams))
+			for i := 0; i < tt.picks; i++ {
+				u := m.Next()
+				if u == nil {
+					t.Fatal("Next returned nil")
+				}
+				for j := range upstreams {
+					if upstreams[j].UpstreamID == u.UpstreamID {
+						counts[j]++
+					}
+				}
+			}
+			for j, want := range tt.want {
+				if counts[j] != want {
+					t.Errorf("upstream %d picked %d times, want %d (all: %v)", j, counts[j], want, counts)
+				}
+			}
+		})
+	}
+}
+
+func TestLeastConnectionsPrefersIdleUpstream(t *testing.T) {
+	m := NewUpstreamManager()
+	m.SetStrategy(StrategyLeastConnections)
+	upstreams := testUpstreams(1, 1)
+	m.SetUpstreams(upstreams)
+	m.Acquire(upstreams[0].UpstreamID)
+	for i := 0; i < 3; i++ {
+		if u := m.Next(); u.UpstreamID != upstreams[1].UpstreamID {
+			t.Fatalf("pick %d: got the busy upstream", i)
+		}
+	}
+	m.Release(upstreams[0].UpstreamID)
+}
+
+func TestLowestLatency(t *testing.T) {
+	m := NewUpstreamManager()
+	m.SetStrategy(StrategyLowestLatency)
+	upstreams := testUpstreams(1, 1, 1)
+	m.SetUpstreams(upstreams)
+	slow, fast, unmeasured := upstreams[0].UpstreamID, upstreams[1].UpstreamID, upstreams[2].UpstreamID
+
+	m.ReportResult(slow, 300*time.Millisecond, false)
+	m.ReportResult(fast, 20*time.Millisecond, false)
+	if u := m.Next(); u.UpstreamID != unmeasured {
+		t.Fatal("an upstream without a latency sample was not tried first")
+	}
+	m.ReportResult(unmeasured, time.Second, false)
+	if u := m.Next(); u.UpstreamID != fast {
+		t.Fatal("the fastest upstream was not picked")
+	}
+
+	// a failed dial counts at least latencyFailurePenalty however fast it failed
+	m.ReportResult(fast, time.Millisecond, true)
+	if u := m.Next(); u.UpstreamID != slow {
+		t.Fatal("an upstream that failed fast kept the lowest latency")
+	}
+}
@@ -0,0 +1,119 @@
+package manager
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// DefaultSessionTTL is used when a client asks for a sticky session without a lifetime
+	DefaultSessionTTL = 10 * time.Minute
+	// MaxSessionTTL caps the lifetime a client may ask for
+	MaxSessionTTL = 24 * time.Hour
+	// sessionSweepInterval is how often expired sessions are removed
+	sessionSweepInterval = 1 * time.Minute
+)
+
+type stickySession struct {
+	upstreamID uuid.UUID
+	ttl        time.Duration
+	expiresAt  time.Time
+}
+
+// SessionManager pins sticky sessions to an upstream so a client keeps the same exit IP.
+// A session expires once it has been idle for its TTL.
+type SessionManager struct {
+	sessions map[string]*stickySession
+	mu       sync.Mutex
+	stopCh   chan struct{}
+}
+
+// NewSessionManager creates an empty session table
+func NewSessionManager() *SessionManager {
+	return &SessionManager{
+		sessions: make(map[string]*stickySession),
+		stopCh:   make(chan struct{}),
+	}
+}
+
+// Start begins periodic removal of expired sessions
+func (m *SessionManager) Start() {
+	go func() {
+		ticker := time.NewTicker(sessionSweepInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				m.sweep()
+			case <-m.stopCh:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the periodic removal of expired sessions
+func (m *SessionManager) Stop() {
+	close(m.stopCh)
+}
+
+// SessionKey builds the session table key, sessions are scoped to the user that created them
+func SessionKey(username, session string) string {
+	return username + ":" + session
+}
+
+// Get returns the upstream a session is pinned to and extends the session
+func (m *SessionManager) Get(key string) (upstreamID uuid.UUID, ok bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.sessions[key]
+	if !ok {
+		return
+	}
+	now := time.Now()
+	if now.After(s.expiresAt) {
+		delete(m.sessions, key)
+		return uuid.Nil, false
+	}
+	s.expiresAt = now.Add(s.ttl)
+	return s.upstreamID, true
+}
+
+// Pin binds a session to an upstream, a zero ttl means DefaultSessionTTL
+func (m *SessionManager) Pin(key string, upstreamID uuid.UUID, ttl time.Duration) {
+	if ttl <= 0 {
+		ttl = DefaultSessionTTL
+	}
+	if ttl > MaxSessionTTL {
+		ttl = MaxSessionTTL
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if s, ok := m.sessions[key]; ok && s.upstreamID != upstreamID {
+		log.Printf("[SessionManager] Session %s moved to upstream %s", key, upstreamID)
+	}
+	m.sessions[key] = &stickySession{
+		upstreamID: upstreamID,
+		ttl:        ttl,
+		expiresAt:  time.Now().Add(ttl),
+	}
+}
+
+func (m *SessionManager) sweep() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	removed := 0
+	for key, s := range m.sessions {
+		if now.After(s.expiresAt) {
+			delete(m.sessions, key)
+			removed++
+		}
+	}
+	if removed > 0 {
+		log.Printf("[SessionManager] Expired %d sessions, active: %d", removed, len(m.sessions))
+	}
+}
@@ -0,0 +1,24 @@
+package manager
+
+import (
+	"net"
+
+	util "github.com/snail007/goproxy/utils"
+)
+
+// Dial connects to the upstream proxy itself, completing the TLS handshake for HTTPS upstreams
+func (u *Upstream) Dial(timeout int) (net.Conn, error) {
+	if u.Protocol() == UpstreamProtocolHTTPS {
+		return util.TlsDialHost(u.GetAddress(), timeout)
+	}
+	return util.ConnectHost(u.GetAddress(), timeout)
+}
+
+// Tunnel asks the upstream on conn to connect to target, with a SOCKS5 handshake for SOCKS5
+// upstreams and an HTTP CONNECT otherwise, authenticating with the upstream credentials
+func (u *Upstream) Tunnel(conn net.Conn, target string, timeout int) error {
+	if u.Protocol() == UpstreamProtocolSOCKS5 {
+		return util.Socks5Connect(conn, target, u.UpstreamUsername, u.UpstreamPassword, timeout)
+	}
+	return util.HTTPConnect(conn, target, u.UpstreamUsername, u.UpstreamPassword, timeout)
+}
@@ -1,10 +1,13 @@
 package manager
 
 import (
+	"errors"
 	"fmt"
 	"log"
+	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/google/uuid"
 )
@@ -17,6 +20,9 @@ type Pool struct {
 	PoolPort      int
 	PoolSubdomain string
 	Upstreams     []Upstream
+	// MaxConnectionsPerUser is the default concurrent connection limit of the pool's users,
+	// zero means unlimited
+	MaxConnectionsPerUser int
 }
 
 type Upstream struct {
@@ -28,9 +34,20 @@ type Upstream struct {
 	UpstreamHost     string
 	UpstreamPort     int
 	UpstreamProvider string
+	UpstreamCountry  string
 	Weight           int
 }
 
+// ErrNoMatchingUpstream is returned when no configured upstream matches the client's targeting
+var ErrNoMatchingUpstream = errors.New("no upstream matches the requested targeting")
+
+// Protocols used to talk to an upstream, selected by Upstream.UpstreamFormat
+const (
+	UpstreamProtocolHTTP   = "http"
+	UpstreamProtocolHTTPS  = "https"
+	UpstreamProtocolSOCKS5 = "socks5"
+)
+
 func NewPool(poolId uuid.UUID, poolTag string, poolPort int, poolSubdomain string, upstreams []Upstream) *Pool {
 	pool := &Pool{
 		PoolId:        poolId,
@@ -43,49 +60,264 @@ func NewPool(poolId uuid.UUID, poolTag string, poolPort int, poolSubdomain strin
 	return pool
 }
 
-// UpstreamManager handles round-robin selection of upstream proxies
+// upstreamState holds the selection state kept for a single upstream
+type upstreamState struct {
+	upstream          Upstream
+	currentWeight     int // smooth weighted round-robin accumulator
+	breaker           *CircuitBreaker
+	activeConnections int64   // atomic, tunnels currently bound to this upstream
+	latencyEWMA       float64 // moving average of connect latency in milliseconds
+	lastProbe         *ProbeResult
+}
+
+// UpstreamStatus is a point-in-time view of an upstream, its breaker and its last probe
+type UpstreamStatus struct {
+	Upstream  Upstream
+	Breaker   BreakerState
+	LastProbe *ProbeResult
+}
+
+// UpstreamManager handles selection of upstream proxies with a pluggable strategy,
+// weighted round-robin by default, skipping upstreams whose circuit breaker is open
 type UpstreamManager struct {
-	upstreams []Upstream
-	index     uint64 // atomic counter for round-robin
+	upstreams []*upstreamState
+	byID      map[uuid.UUID]*upstreamState
+	selector  selector
+	strategy  string
+	listeners []func([]Upstream)
 	mu        sync.RWMutex
 }
 
 // NewUpstreamManager creates a new upstream manager
 func NewUpstreamManager() *UpstreamManager {
+	sel, strategy := newSelector(StrategyWeighted)
 	return &UpstreamManager{
-		upstreams: make([]Upstream, 0),
+		upstreams: make([]*upstreamState, 0),
+		byID:      make(map[uuid.UUID]*upstreamState),
+		selector:  sel,
+		strategy:  strategy,
 	}
 }
 
-// SetUpstreams updates the list of available upstreams (called when Captain sends config)
-func (m *UpstreamManager) SetUpstreams(upstreams []Upstream) {
+// SetStrategy changes the selection strategy, see the Strategy constants
+func (m *UpstreamManager) SetStrategy(strategy string) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	m.upstreams = upstreams
+	sel, name := newSelector(strategy)
+	if name == m.strategy {
+		return
+	}
+	m.selector, m.strategy = sel, name
+	log.Printf("[UpstreamManager] Selection strategy: %s", name)
+}
+
+// SetUpstreams updates the list of available upstreams (called when Captain sends config).
+// Selection state is kept for upstreams that are still present so that a config
+// push does not reset the weighted rotation.
+func (m *UpstreamManager) SetUpstreams(upstreams []Upstream) {
+	m.mu.Lock()
+	defer func() {
+		listeners := m.listeners
+		m.mu.Unlock()
+		for _, fn := range listeners {
+			fn(upstreams)
+		}
+	}()
+
+	states := make([]*upstreamState, 0, len(upstreams))
+	byID := make(map[uuid.UUID]*upstreamState, len(upstreams))
+	for _, u := range upstreams {
+		state, ok := m.byID[u.UpstreamID]
+		if !ok {
+			state = &upstreamState{breaker: NewCircuitBreaker(u.GetAddress())}
+		}
+		state.upstream = u
+		states = append(states, state)
+		byID[u.UpstreamID] = state
+	}
+	m.upstreams = states
+	m.byID = byID
+
 	log.Printf("[UpstreamManager] Updated upstreams, count: %d", len(upstreams))
 	for i, u := range upstreams {
-		log.Printf("[UpstreamManager] Upstream %d: %s:%d (tag: %s)", i, u.UpstreamHost, u.UpstreamPort, u.UpstreamTag)
+		log.Printf("[UpstreamManager] Upstream %d: %s:%d (tag: %s, weight: %d)", i, u.UpstreamHost, u.UpstreamPort, u.UpstreamTag, u.Weight)
+	}
+}
+
+// Subscribe registers fn to be called with the upstream list whenever it changes,
+// and once right away with the current list
+func (m *UpstreamManager) Subscribe(fn func([]Upstream)) {
+	m.mu.Lock()
+	m.listeners = append(m.listeners, fn)
+	current := make([]Upstream, 0, len(m.upstreams))
+	for _, state := range m.upstreams {
+		current = append(current, state.upstream)
 	}
+	m.mu.Unlock()
+	fn(current)
 }
 
-// Next returns the next upstream using round-robin selection
-// Returns nil if no upstreams are configured
+// UpstreamFilter reports whether an upstream may be selected.
+// It is called with the manager locked and must not call back into it.
+type UpstreamFilter func(u *Upstream) bool
+
+// Next returns the next upstream chosen by the selection strategy.
+// Upstreams with a weight of zero are configured but disabled and never selected,
+// upstreams with an open circuit breaker are skipped until their cool-down ends.
+// Returns nil if no enabled and healthy upstreams are configured
 func (m *UpstreamManager) Next() *Upstream {
+	return m.NextWhere(nil)
+}
+
+// NextWhere is like Next but only considers upstreams accepted by filter, a nil filter accepts all
+func (m *UpstreamManager) NextWhere(filter UpstreamFilter) *Upstream {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	skip := make(map[*upstreamState]bool)
+	for len(skip) < len(m.upstreams) {
+		candidates := make([]*upstreamState, 0, len(m.upstreams))
+		for _, state := range m.upstreams {
+			if skip[state] || state.upstream.Weight <= 0 || !state.breaker.Ready() {
+				continue
+			}
+			if filter != nil && !filter(&state.upstream) {
+				continue
+			}
+			candidates = append(candidates, state)
+		}
+		if len(candidates) == 0 {
+			return nil
+		}
+		best := m.selector.Select(candidates)
+
+		// the breaker may have changed since Ready, e.g. a concurrent dial reopened it
+		if !best.breaker.Allow() {
+			skip[best] = true
+			continue
+		}
+
+		upstream := best.upstream
+		log.Printf("[UpstreamManager] %s selected upstream: %s:%d (weight: %d)", m.strategy, upstream.UpstreamHost, upstream.UpstreamPort, upstream.Weight)
+		return &upstream
+	}
+	return nil
+}
+
+// Pinned returns the upstream with the given ID if it is still configured, enabled, accepted by
+// filter and its circuit breaker allows traffic. Returns nil otherwise so the caller can pick a new one
+func (m *UpstreamManager) Pinned(upstreamID uuid.UUID, filter UpstreamFilter) *Upstream {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	state, ok := m.byID[upstreamID]
+	if !ok || state.upstream.Weight <= 0 || (filter != nil && !filter(&state.upstream)) || !state.breaker.Allow() {
+		return nil
+	}
+	upstream := state.upstream
+	return &upstream
+}
+
+// HasMatch reports whether any enabled upstream is accepted by filter, regardless of its health
+func (m *UpstreamManager) HasMatch(filter UpstreamFilter) bool {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
+	for _, state := range m.upstreams {
+		if state.upstream.Weight > 0 && (filter == nil || filter(&state.upstream)) {
+			return true
+		}
+	}
+	return false
+}
 
-	if len(m.upstreams) == 0 {
-		return nil
+// ReportResult feeds the outcome of a dial to an upstream into its circuit breaker and into
+// its latency moving average, a failed dial counting as at least latencyFailurePenalty
+func (m *UpstreamManager) ReportResult(upstreamID uuid.UUID, latency time.Duration, failed bool) {
+	m.mu.Lock()
+	state, ok := m.byID[upstreamID]
+	if ok {
+		if failed && latency < latencyFailurePenalty {
+			latency = latencyFailurePenalty
+		}
+		sample := float64(latency) / float64(time.Millisecond)
+		if state.latencyEWMA == 0 {
+			state.latencyEWMA = sample
+		} else {
+			state.latencyEWMA = latencyEWMAAlpha*sample + (1-latencyEWMAAlpha)*state.latencyEWMA
+		}
+	}
+	m.mu.Unlock()
+	if !ok {
+		return
 	}
+	state.breaker.Record(failed)
+}
 
-	// Atomic increment and get index
-	idx := atomic.AddUint64(&m.index, 1) - 1
-	selectedIdx := idx % uint64(len(m.upstreams))
+// ReportOutcome feeds the outcome of a request to an upstream into its circuit breaker only,
+// for requests whose latency says nothing about the upstream, e.g. served by a warm connection
+func (m *UpstreamManager) ReportOutcome(upstreamID uuid.UUID, failed bool) {
+	m.mu.RLock()
+	state, ok := m.byID[upstreamID]
+	m.mu.RUnlock()
+	if ok {
+		state.breaker.Record(failed)
+	}
+}
 
-	upstream := m.upstreams[selectedIdx]
-	log.Printf("[UpstreamManager] Round-robin selected upstream %d: %s:%d", selectedIdx, upstream.UpstreamHost, upstream.UpstreamPort)
+// RecordProbe stores the result of an active probe and feeds it into the selection state
+// like a dial made for a client
+func (m *UpstreamManager) RecordProbe(upstreamID uuid.UUID, result ProbeResult) {
+	m.mu.Lock()
+	state, ok := m.byID[upstreamID]
+	if ok {
+		state.lastProbe = &result
+	}
+	m.mu.Unlock()
+	if ok {
+		m.ReportResult(upstreamID, result.ConnectLatency+result.HandshakeLatency, result.Err != nil)
+	}
+}
 
-	return &upstream
+// Acquire counts a tunnel bound to an upstream, pair every call with Release
+func (m *UpstreamManager) Acquire(upstreamID uuid.UUID) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if state, ok := m.byID[upstreamID]; ok {
+		atomic.AddInt64(&state.activeConnections, 1)
+	}
+}
+
+// Release counts a tunnel to an upstream as closed
+func (m *UpstreamManager) Release(upstreamID uuid.UUID) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if state, ok := m.byID[upstreamID]; ok {
+		atomic.AddInt64(&state.activeConnections, -1)
+	}
+}
+
+// BreakerState returns the circuit breaker state of an upstream, closed if it is unknown
+func (m *UpstreamManager) BreakerState(upstreamID uuid.UUID) BreakerState {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if state, ok := m.byID[upstreamID]; ok {
+		return state.breaker.State()
+	}
+	return BreakerClosed
+}
+
+// Statuses returns the current status of every configured upstream
+func (m *UpstreamManager) Statuses() []UpstreamStatus {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	statuses := make([]UpstreamStatus, 0, len(m.upstreams))
+	for _, state := range m.upstreams {
+		statuses = append(statuses, UpstreamStatus{
+			Upstream:  state.upstream,
+			Breaker:   state.breaker.State(),
+			LastProbe: state.lastProbe,
+		})
+	}
+	return statuses
 }
 
 // HasUpstreams returns true if there are upstreams configured
@@ -106,3 +338,23 @@ func (m *UpstreamManager) Count() int {
 func (u *Upstream) GetAddress() string {
 	return fmt.Sprintf("%s:%d", u.UpstreamHost, u.UpstreamPort)
 }
+
+// Matches reports whether the upstream satisfies the requested country, tag and provider,
+// compared case-insensitively. Empty values match any upstream
+func (u *Upstream) Matches(country, tag, provider string) bool {
+	return (country == "" || strings.EqualFold(u.UpstreamCountry, country)) &&
+		(tag == "" || strings.EqualFold(u.UpstreamTag, tag)) &&
+		(provider == "" || strings.EqualFold(u.UpstreamProvider, provider))
+}
+
+// Protocol returns the protocol spoken to the upstream, plain HTTP proxy unless Captain marks it otherwise
+func (u *Upstream) Protocol() string {
+	switch strings.ToLower(strings.TrimSpace(u.UpstreamFormat)) {
+	case "socks5", "socks5h", "socks":
+		return UpstreamProtocolSOCKS5
+	case "https", "tls", "http+tls":
+		return UpstreamProtocolHTTPS
+	default:
+		return UpstreamProtocolHTTP
+	}
+}
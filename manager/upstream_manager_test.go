@@ -0,0 +1,100 @@
+package manager
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func testUpstreams(weights ...int) []Upstream {
+	upstreams := make([]Upstream, len(weights))
+	for i, w := range weights {
+		upstreams[i] = Upstream{
+			UpstreamID:   uuid.New(),
+			UpstreamHost: fmt.Sprintf("10.0.0.%d", i+1),
+			UpstreamPort: 8080,
+			Weight:       w,
+		}
+	}
+	return upstreams
+}
+
+func TestWeightedRoundRobinDistribution(t *testing.T) {
+	tests := []struct {
+		name    string
+		weights []int
+	}{
+		{"equal", []int{1, 1, 1}},
+		{"skewed", []int{5, 1, 1}},
+		{"two", []int{3, 2}},
+		{"single", []int{4}},
+		{"disabled", []int{2, 0, 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewUpstreamManager()
+			upstreams := testUpstreams(tt.weights...)
+			m.SetUpstreams(upstreams)
+
+			total := 0
+			for _, w := range tt.weights {
+				total += w
+			}
+			counts := make(map[uuid.UUID]int)
+			for round := 0; round < 3; round++ {
+				for i := 0; i < total; i++ {
+					u := m.Next()
+					if u == nil {
+						t.Fatal("Next returned nil")
+					}
+					counts[u.UpstreamID]++
+				}
+			}
+			for i, u := range upstreams {
+				if want := 3 * tt.weights[i]; counts[u.UpstreamID] != want {
+					t.Errorf("upstream %d (weight %d) selected %d times, want %d", i, tt.weights[i], counts[u.UpstreamID], want)
+				}
+			}
+		})
+	}
+}
+
+func TestWeightedRoundRobinIsSmooth(t *testing.T) {
+	m := NewUpstreamManager()
+	upstreams := testUpstreams(5, 1, 1)
+	m.SetUpstreams(upstreams)
+
+	// nginx's smooth weighted round-robin interleaves instead of picking a five times in a row
+	want := []int{0, 0, 1, 0, 2, 0, 0}
+	for i, idx := range want {
+		if u := m.Next(); u.UpstreamID != upstreams[idx].UpstreamID {
+			t.Fatalf("pick %d: got %s, want upstream %d", i, u.GetAddress(), idx)
+		}
+	}
+}
+
+func TestZeroWeightUpstreamsAreNeverSelected(t *testing.T) {
+	m := NewUpstreamManager()
+	m.SetUpstreams(testUpstreams(0, 0))
+	if u := m.Next(); u != nil {
+		t.Fatalf("Next = %s, want nil when every upstream has weight 0", u.GetAddress())
+	}
+	if m.HasMatch(nil) {
+		t.Error("HasMatch = true, want false when every upstream has weight 0")
+	}
+}
+
+func TestOpenBreakerIsSkipped(t *testing.T) {
+	m := NewUpstreamManager()
+	upstreams := testUpstreams(1, 1)
+	m.SetUpstreams(upstreams)
+	for i := 0; i < breakerConsecutiveFailures; i++ {
+		m.ReportResult(upstreams[0].UpstreamID, 0, true)
+	}
+	for i := 0; i < 4; i++ {
+		if u := m.Next(); u.UpstreamID != upstreams[1].UpstreamID {
+			t.Fatalf("pick %d: got %s, want the upstream with a closed breaker", i, u.GetAddress())
+		}
+	}
+}
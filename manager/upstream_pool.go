@@ -0,0 +1,125 @@
+package manager
+
+import (
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	util "github.com/snail007/goproxy/utils"
+)
+
+// upstreamPoolMaxIdle is how long a warm connection may sit idle before it is replaced,
+// upstream proxies tend to close idle client connections after a minute
+const upstreamPoolMaxIdle = 30 * time.Second
+
+// UpstreamPools keeps a few pre-dialed connections to every configured upstream, keyed by
+// UpstreamID, so the TCP (and TLS) handshake is off the request path. Pools follow the
+// upstream list of the UpstreamManager: new upstreams get a pool, changed ones are rebuilt
+// and removed ones are drained.
+type UpstreamPools struct {
+	upstreamMgr  *UpstreamManager
+	pools        *util.KeyedPool
+	fingerprints map[uuid.UUID]string
+	timeout      int
+	users        int // services that started the pools
+	mu           sync.Mutex
+}
+
+// NewUpstreamPools creates the pools for upstreamMgr, they stay empty until Start
+func NewUpstreamPools(upstreamMgr *UpstreamManager) *UpstreamPools {
+	return &UpstreamPools{
+		upstreamMgr:  upstreamMgr,
+		fingerprints: make(map[uuid.UUID]string),
+	}
+}
+
+// Start keeps size connections per upstream, dialed with timeout milliseconds. The pools are
+// shared by the services of the worker, the first to start them sets size and timeout, and
+// every Start must be paired with a Stop.
+func (p *UpstreamPools) Start(size, timeout int) {
+	p.mu.Lock()
+	p.users++
+	if p.pools != nil || size <= 0 {
+		p.mu.Unlock()
+		return
+	}
+	p.pools = util.NewKeyedPool(size, upstreamPoolMaxIdle)
+	p.timeout = timeout
+	p.mu.Unlock()
+	log.Printf("[UpstreamPools] Started, %d warm connections per upstream", size)
+	p.upstreamMgr.Subscribe(p.sync)
+}
+
+// Get returns a warm connection to the upstream, ok is false when none is ready
+func (p *UpstreamPools) Get(upstreamID uuid.UUID) (conn net.Conn, ok bool) {
+	p.mu.Lock()
+	pools := p.pools
+	p.mu.Unlock()
+	if pools == nil {
+		return nil, false
+	}
+	return pools.Get(upstreamID.String())
+}
+
+// Stop drains every pool once the last service using them stopped
+func (p *UpstreamPools) Stop() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.users > 0 {
+		p.users--
+	}
+	if p.users == 0 && p.pools != nil {
+		p.pools.ReleaseAll()
+		p.fingerprints = make(map[uuid.UUID]string)
+	}
+}
+
+// dial opens a warm connection to upstream unless its breaker keeps it out of rotation, a
+// failed dial is reported to the UpstreamManager like one made for a client
+func (p *UpstreamPools) dial(upstream Upstream, timeout int) (net.Conn, error) {
+	if p.upstreamMgr.BreakerState(upstream.UpstreamID) != BreakerClosed {
+		return nil, util.ErrSkipFill
+	}
+	start := time.Now()
+	conn, err := upstream.Dial(timeout)
+	if err != nil {
+		p.upstreamMgr.ReportResult(upstream.UpstreamID, time.Since(start), true)
+	}
+	return conn, err
+}
+
+// sync rebuilds the pools for a new upstream list
+func (p *UpstreamPools) sync(upstreams []Upstream) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.pools == nil {
+		return
+	}
+	current := make(map[uuid.UUID]bool, len(upstreams))
+	for _, u := range upstreams {
+		if u.Weight <= 0 {
+			continue
+		}
+		current[u.UpstreamID] = true
+		// credentials are only used in the handshake, so they do not invalidate warm connections
+		fingerprint := u.Protocol() + "://" + u.GetAddress()
+		if p.fingerprints[u.UpstreamID] == fingerprint {
+			continue
+		}
+		p.fingerprints[u.UpstreamID] = fingerprint
+		upstream := u
+		timeout := p.timeout
+		p.pools.Set(u.UpstreamID.String(), func() (net.Conn, error) {
+			return p.dial(upstream, timeout)
+		})
+	}
+	for id := range p.fingerprints {
+		if !current[id] {
+			delete(p.fingerprints, id)
+			p.pools.Remove(id.String())
+			log.Printf("[UpstreamPools] Drained pool of removed upstream %s", id)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package manager
+
+import (
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	util "github.com/snail007/goproxy/utils"
+)
+
+// listenUpstream accepts connections like an upstream proxy and counts them
+func listenUpstream(t *testing.T) (upstream Upstream, accepted *int32) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	accepted = new(int32)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(accepted, 1)
+			t.Cleanup(func() { conn.Close() })
+		}
+	}()
+	host, port, _ := net.SplitHostPort(ln.Addr().String())
+	upstream = testUpstreams(1)[0]
+	upstream.UpstreamHost = host
+	upstream.UpstreamPort, _ = strconv.Atoi(port)
+	return upstream, accepted
+}
+
+func TestUpstreamPoolsServeWarmConnections(t *testing.T) {
+	m := NewUpstreamManager()
+	p := NewUpstreamPools(m)
+	p.Start(2, 1000)
+	p.Start(2, 1000)
+	upstream, _ := listenUpstream(t)
+	m.SetUpstreams([]Upstream{upstream})
+
+	warm := func() net.Conn {
+		deadline := time.Now().Add(2 * time.Second)
+		for time.Now().Before(deadline) {
+			if conn, ok := p.Get(upstream.UpstreamID); ok {
+				return conn
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		return nil
+	}
+	conn := warm()
+	if conn == nil {
+		t.Fatal("no warm connection to the upstream")
+	}
+	conn.Close()
+
+	// the pools are shared, the first Stop only releases one service
+	p.Stop()
+	if conn = warm(); conn == nil {
+		t.Fatal("pools were drained while a service still used them")
+	}
+	conn.Close()
+	p.Stop()
+	if _, ok := p.Get(upstream.UpstreamID); ok {
+		t.Error("warm connection handed out after the last Stop")
+	}
+}
+
+func TestUpstreamPoolsSkipTrippedUpstreams(t *testing.T) {
+	m := NewUpstreamManager()
+	p := NewUpstreamPools(m)
+	upstream, accepted := listenUpstream(t)
+	m.SetUpstreams([]Upstream{upstream})
+
+	conn, err := p.dial(upstream, 1000)
+	if err != nil {
+		t.Fatalf("dial = %v, want a connection", err)
+	}
+	conn.Close()
+	for i := 0; i < breakerConsecutiveFailures; i++ {
+		m.ReportResult(upstream.UpstreamID, 0, true)
+	}
+	if _, err := p.dial(upstream, 1000); err != util.ErrSkipFill {
+		t.Fatalf("dial to a tripped upstream = %v, want %v", err, util.ErrSkipFill)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadInt32(accepted); n != 1 {
+		t.Errorf("upstream accepted %d connections, want 1", n)
+	}
+}
+
+func TestReportOutcomeKeepsLatency(t *testing.T) {
+	m := NewUpstreamManager()
+	upstreams := testUpstreams(1)
+	m.SetUpstreams(upstreams)
+	id := upstreams[0].UpstreamID
+	m.ReportResult(id, 200*time.Millisecond, false)
+	for i := 0; i < 3; i++ {
+		m.ReportOutcome(id, false)
+	}
+	if ewma := m.byID[id].latencyEWMA; ewma != 200 {
+		t.Errorf("latency average = %vms after warm-pool hits, want 200ms", ewma)
+	}
+	for i := 0; i < breakerConsecutiveFailures; i++ {
+		m.ReportOutcome(id, true)
+	}
+	if state := m.BreakerState(id); state != BreakerOpen {
+		t.Errorf("breaker %s after failed warm-pool hits, want open", state)
+	}
+}
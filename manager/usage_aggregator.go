@@ -0,0 +1,208 @@
+package manager
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// DefaultUsageFlushInterval is how often aggregated usage is sent to Captain
+	DefaultUsageFlushInterval = 10 * time.Second
+	// DefaultUsageFlushSize sends a batch early once this many records are pending
+	DefaultUsageFlushSize = 1000
+)
+
+// usageKey is what usage of connections is aggregated by
+type usageKey struct {
+	username string
+	poolID   uuid.UUID
+	protocol string
+	host     string
+	connID   string
+}
+
+// UsageAggregator sums the usage of connections per user, pool, protocol and destination
+// host, and per connection for those reported while open. It sends the sums to Captain as
+// one batch every FlushInterval or as soon as FlushSize records are pending. Closing a
+// tunnel only updates a map, it never waits for Captain. Records a batch could not be sent
+// with are kept for the next one.
+type UsageAggregator struct {
+	// FlushInterval is how often pending records are sent
+	FlushInterval time.Duration
+	// FlushSize sends pending records early once there are this many, zero or less means
+	// only on the interval
+	FlushSize int
+
+	send    func(batch UsageBatch) bool
+	records map[usageKey]*UsageRecord
+	since   time.Time
+	mu      sync.Mutex
+	flushCh chan struct{}
+	stopCh  chan struct{}
+	done    chan struct{} // closed once the final batch was handed to send
+}
+
+// NewUsageAggregator creates an aggregator handing its batches to send, which returns
+// false when the batch could not be delivered
+func NewUsageAggregator(interval time.Duration, size int, send func(batch UsageBatch) bool) *UsageAggregator {
+	return &UsageAggregator{
+		FlushInterval: interval,
+		FlushSize:     size,
+		send:          send,
+		records:       make(map[usageKey]*UsageRecord),
+		flushCh:       make(chan struct{}, 1),
+		stopCh:        make(chan struct{}),
+	}
+}
+
+// Start begins sending batches
+func (a *UsageAggregator) Start() {
+	interval := a.FlushInterval
+	if interval <= 0 {
+		interval = DefaultUsageFlushInterval
+	}
+	a.done = make(chan struct{})
+	go func() {
+		defer close(a.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				a.Flush()
+			case <-a.flushCh:
+				a.Flush()
+			case <-a.stopCh:
+				a.Flush()
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops sending batches and returns once the pending records were handed to send
+func (a *UsageAggregator) Stop() {
+	if a.done == nil {
+		a.Flush()
+		return
+	}
+	close(a.stopCh)
+	<-a.done
+}
+
+// Add counts the usage of a connection, an interim or final record of it
+func (a *UsageAggregator) Add(usage UserDataUsage) {
+	key := usageKey{
+		username: usage.Username,
+		poolID:   usage.PoolID,
+		protocol: usage.Protocol,
+		host:     usage.DestinationHost,
+		connID:   usage.ConnectionID,
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(a.records) == 0 {
+		a.since = time.Now()
+	}
+	record, ok := a.records[key]
+	if !ok {
+		record = &UsageRecord{
+			UserID:          usage.UserID,
+			Username:        usage.Username,
+			PoolID:          usage.PoolID,
+			PoolName:        usage.PoolName,
+			Protocol:        usage.Protocol,
+			DestinationHost: usage.DestinationHost,
+			ConnectionID:    usage.ConnectionID,
+		}
+		a.records[key] = record
+		// signal only when crossing the threshold, records kept after a failed send
+		// wait for the next interval
+		if a.FlushSize > 0 && len(a.records) == a.FlushSize {
+			select {
+			case a.flushCh <- struct{}{}:
+			default:
+			}
+		}
+	}
+	if record.UserID == uuid.Nil {
+		record.UserID = usage.UserID
+	}
+	record.BytesSent += usage.BytesSent
+	record.BytesReceived += usage.BytesReceived
+	if usage.Final {
+		// interim records of an open connection do not count it yet
+		record.Connections++
+		record.Final = usage.ConnectionID != ""
+	}
+}
+
+// Pending returns the number of records waiting to be sent
+func (a *UsageAggregator) Pending() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return len(a.records)
+}
+
+// Flush sends the pending records as one batch
+func (a *UsageAggregator) Flush() {
+	a.mu.Lock()
+	if len(a.records) == 0 {
+		a.mu.Unlock()
+		return
+	}
+	records, since := a.records, a.since
+	a.records = make(map[usageKey]*UsageRecord)
+	a.mu.Unlock()
+
+	batch := UsageBatch{
+		PeriodStart: since,
+		PeriodEnd:   time.Now(),
+		Records:     make([]UsageRecord, 0, len(records)),
+	}
+	for _, record := range records {
+		batch.Records = append(batch.Records, *record)
+	}
+	if a.send(batch) {
+		return
+	}
+	a.restore(records, since)
+}
+
+// restore merges records of a batch that could not be sent back into the pending ones
+func (a *UsageAggregator) restore(records map[usageKey]*UsageRecord, since time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(a.records) == 0 || since.Before(a.since) {
+		a.since = since
+	}
+	for key, record := range records {
+		pending, ok := a.records[key]
+		if !ok {
+			a.records[key] = record
+			continue
+		}
+		if pending.UserID == uuid.Nil {
+			pending.UserID = record.UserID
+		}
+		pending.BytesSent += record.BytesSent
+		pending.BytesReceived += record.BytesReceived
+		pending.Connections += record.Connections
+		pending.Final = pending.Final || record.Final
+	}
+}
+
+// sendUsageBatch spools a batch of aggregated usage for Captain, a batch that could not be
+// written to the spool file leaves its records with the aggregator for the next one
+func (c *Worker) sendUsageBatch(batch UsageBatch) bool {
+	batch.WorkerID, _ = uuid.Parse(c.WorkerID)
+	batch.WorkerRegion = c.GetPoolRegion()
+	if err := c.Spool.Append(batch); err != nil {
+		log.Printf("[UsageSpool] Failed to spool usage batch, keeping its %d records for the next one: %v", len(batch.Records), err)
+		return false
+	}
+	return true
+}
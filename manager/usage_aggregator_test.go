@@ -0,0 +1,148 @@
+package manager
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// batchRecorder collects the batches of an aggregator, failing sends while fail is set
+type batchRecorder struct {
+	mu      sync.Mutex
+	fail    bool
+	batches []UsageBatch
+	sent    chan struct{}
+}
+
+func newBatchRecorder() *batchRecorder {
+	return &batchRecorder{sent: make(chan struct{}, 16)}
+}
+
+func (r *batchRecorder) send(batch UsageBatch) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.fail {
+		return false
+	}
+	r.batches = append(r.batches, batch)
+	r.sent <- struct{}{}
+	return true
+}
+
+func (r *batchRecorder) records() map[string]UsageRecord {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	records := make(map[string]UsageRecord)
+	for _, batch := range r.batches {
+		for _, record := range batch.Records {
+			records[record.Username+" "+record.DestinationHost+" "+record.ConnectionID] = record
+		}
+	}
+	return records
+}
+
+func TestUsageAggregatorSumsByKey(t *testing.T) {
+	r := newBatchRecorder()
+	a := NewUsageAggregator(time.Hour, 0, r.send)
+	poolID := uuid.New()
+	usage := []UserDataUsage{
+		{Username: "alice", PoolID: poolID, Protocol: "http", DestinationHost: "a.example", BytesSent: 10, BytesReceived: 100, Final: true},
+		{Username: "alice", PoolID: poolID, Protocol: "http", DestinationHost: "a.example", BytesSent: 5, BytesReceived: 50, Final: true},
+		{Username: "alice", PoolID: poolID, Protocol: "http", DestinationHost: "b.example", BytesSent: 1, Final: true},
+		{Username: "bob", PoolID: poolID, Protocol: "http", DestinationHost: "a.example", BytesReceived: 7, Final: true},
+		{Username: "alice", PoolID: poolID, Protocol: "http", DestinationHost: "a.example", ConnectionID: "c1", BytesSent: 3},
+		{Username: "alice", PoolID: poolID, Protocol: "http", DestinationHost: "a.example", ConnectionID: "c1", BytesSent: 4, Final: true},
+	}
+	for _, u := range usage {
+		a.Add(u)
+	}
+	if n := a.Pending(); n != 4 {
+		t.Fatalf("Pending = %d, want 4", n)
+	}
+	a.Flush()
+	if len(r.batches) != 1 {
+		t.Fatalf("sent %d batches, want 1", len(r.batches))
+	}
+
+	records := r.records()
+	tests := []struct {
+		key         string
+		sent, recv  uint64
+		connections uint64
+		final       bool
+	}{
+		{"alice a.example ", 15, 150, 2, false},
+		{"alice b.example ", 1, 0, 1, false},
+		{"bob a.example ", 0, 7, 1, false},
+		{"alice a.example c1", 7, 0, 1, true},
+	}
+	for _, tt := range tests {
+		got, ok := records[tt.key]
+		if !ok {
+			t.Errorf("no record for %q", tt.key)
+			continue
+		}
+		if got.BytesSent != tt.sent || got.BytesReceived != tt.recv || got.Connections != tt.connections || got.Final != tt.final {
+			t.Errorf("record %q = %+v, want sent %d received %d connections %d final %v", tt.key, got, tt.sent, tt.recv, tt.connections, tt.final)
+		}
+	}
+	if a.Pending() != 0 {
+		t.Error("records are still pending after a sent batch")
+	}
+}
+
+func TestUsageAggregatorKeepsUnsentRecords(t *testing.T) {
+	r := newBatchRecorder()
+	r.fail = true
+	a := NewUsageAggregator(time.Hour, 0, r.send)
+	a.Add(UserDataUsage{Username: "alice", DestinationHost: "a.example", BytesSent: 10, Final: true})
+	a.Flush()
+	if n := a.Pending(); n != 1 {
+		t.Fatalf("Pending = %d after a failed send, want 1", n)
+	}
+
+	a.Add(UserDataUsage{Username: "alice", DestinationHost: "a.example", BytesSent: 5, Final: true})
+	r.fail = false
+	a.Flush()
+	got := r.records()["alice a.example "]
+	if got.BytesSent != 15 || got.Connections != 2 {
+		t.Errorf("record = %+v, want the failed batch merged into the next one", got)
+	}
+}
+
+func TestUsageAggregatorFlushSize(t *testing.T) {
+	r := newBatchRecorder()
+	a := NewUsageAggregator(time.Hour, 2, r.send)
+	a.Start()
+	defer a.Stop()
+	a.Add(UserDataUsage{Username: "alice", DestinationHost: "a.example", Final: true})
+	a.Add(UserDataUsage{Username: "alice", DestinationHost: "a.example", Final: true})
+	select {
+	case <-r.sent:
+		t.Fatal("batch sent before FlushSize distinct records were pending")
+	case <-time.After(50 * time.Millisecond):
+	}
+	a.Add(UserDataUsage{Username: "bob", DestinationHost: "a.example", Final: true})
+	select {
+	case <-r.sent:
+	case <-time.After(time.Second):
+		t.Fatal("batch not sent once FlushSize records were pending")
+	}
+}
+
+func TestUsageAggregatorStopFlushes(t *testing.T) {
+	for _, started := range []bool{true, false} {
+		r := newBatchRecorder()
+		a := NewUsageAggregator(time.Hour, 0, r.send)
+		if started {
+			a.Start()
+		}
+		a.Add(UserDataUsage{Username: "alice", BytesSent: 1, Final: true})
+		a.Stop()
+		if len(r.records()) != 1 {
+			t.Errorf("started=%v: Stop returned before the pending records were sent", started)
+		}
+	}
+}
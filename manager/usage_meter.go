@@ -0,0 +1,171 @@
+package manager
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// DefaultUsageInterimInterval is how often the usage of open connections is reported
+const DefaultUsageInterimInterval = time.Minute
+
+// ConnectionUsage counts the bytes of one open connection. Connections open longer than
+// the interim interval report what they transferred since their last report under their
+// ConnectionID, and a final record when they close, so Captain can stitch them together.
+// Connections closing before their first interim report send one record without an ID
+// that is aggregated with others. A nil *ConnectionUsage counts nothing.
+type ConnectionUsage struct {
+	sent     uint64
+	received uint64
+
+	meter    *UsageMeter
+	usage    UserDataUsage // the connection's fields, bytes are the reported totals
+	reported bool          // an interim record was sent
+	closed   bool
+	mu       sync.Mutex
+}
+
+// UsageMeter tracks the usage of open connections and hands interim and final records to
+// the usage aggregator
+type UsageMeter struct {
+	// Interval between interim reports of an open connection, zero or less means records
+	// are only sent on close
+	Interval time.Duration
+
+	usage  *UsageAggregator
+	conns  map[string]*ConnectionUsage
+	mu     sync.Mutex
+	stopCh chan struct{}
+	done   chan struct{} // closed once interim reporting stopped
+}
+
+// NewUsageMeter creates a meter adding its records to usage
+func NewUsageMeter(interval time.Duration, usage *UsageAggregator) *UsageMeter {
+	return &UsageMeter{
+		Interval: interval,
+		usage:    usage,
+		conns:    make(map[string]*ConnectionUsage),
+		stopCh:   make(chan struct{}),
+	}
+}
+
+// Start begins interim reporting
+func (m *UsageMeter) Start() {
+	if m.Interval <= 0 {
+		return
+	}
+	m.done = make(chan struct{})
+	go func() {
+		defer close(m.done)
+		ticker := time.NewTicker(m.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				m.Report()
+			case <-m.stopCh:
+				return
+			}
+		}
+	}()
+}
+
+// Stop ends interim reporting and reports what open connections transferred so far, so their
+// bytes reach the aggregator before shutdown
+func (m *UsageMeter) Stop() {
+	if m.done != nil {
+		close(m.stopCh)
+		<-m.done
+	}
+	m.Report()
+}
+
+// Open starts counting a connection described by usage, its byte counts are ignored
+func (m *UsageMeter) Open(usage UserDataUsage) *ConnectionUsage {
+	usage.ConnectionID = uuid.New().String()
+	usage.BytesSent, usage.BytesReceived = 0, 0
+	cu := &ConnectionUsage{meter: m, usage: usage}
+	m.mu.Lock()
+	m.conns[usage.ConnectionID] = cu
+	m.mu.Unlock()
+	return cu
+}
+
+// Active returns the number of open connections
+func (m *UsageMeter) Active() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.conns)
+}
+
+// Report sends the interim usage of every open connection that transferred bytes since
+// its last report
+func (m *UsageMeter) Report() {
+	m.mu.Lock()
+	conns := make([]*ConnectionUsage, 0, len(m.conns))
+	for _, cu := range m.conns {
+		conns = append(conns, cu)
+	}
+	m.mu.Unlock()
+	for _, cu := range conns {
+		cu.report(false)
+	}
+}
+
+// Add counts n bytes, isDownload tells received from sent
+func (cu *ConnectionUsage) Add(n int, isDownload bool) {
+	if cu == nil {
+		return
+	}
+	if isDownload {
+		atomic.AddUint64(&cu.received, uint64(n))
+	} else {
+		atomic.AddUint64(&cu.sent, uint64(n))
+	}
+}
+
+// Close sends the final usage of the connection, calling it again does nothing
+func (cu *ConnectionUsage) Close() {
+	if cu == nil {
+		return
+	}
+	cu.meter.mu.Lock()
+	delete(cu.meter.conns, cu.usage.ConnectionID)
+	cu.meter.mu.Unlock()
+	cu.report(true)
+}
+
+// report adds the bytes transferred since the last report to the aggregator
+func (cu *ConnectionUsage) report(final bool) {
+	cu.mu.Lock()
+	defer cu.mu.Unlock()
+	if cu.closed {
+		return
+	}
+	sent, received := atomic.LoadUint64(&cu.sent), atomic.LoadUint64(&cu.received)
+	delta := cu.usage
+	delta.BytesSent = sent - cu.usage.BytesSent
+	delta.BytesReceived = received - cu.usage.BytesReceived
+	if final {
+		cu.closed = true
+		if !cu.reported {
+			if delta.BytesSent == 0 && delta.BytesReceived == 0 {
+				return
+			}
+			delta.ConnectionID = ""
+		}
+		delta.Final = true
+	} else if delta.BytesSent == 0 && delta.BytesReceived == 0 {
+		return
+	}
+	cu.usage.BytesSent, cu.usage.BytesReceived = sent, received
+	cu.reported = cu.reported || !final
+	cu.meter.usage.Add(delta)
+}
+
+// MeterUsage starts counting an open connection for interim and final usage reports
+func (c *Worker) MeterUsage(usage UserDataUsage) *ConnectionUsage {
+	return c.Meter.Open(usage)
+}
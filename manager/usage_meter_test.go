@@ -0,0 +1,108 @@
+package manager
+
+import (
+	"testing"
+	"time"
+)
+
+// collectUsage returns a meter whose interim reports are only sent by Report, and the
+// recorder of the batches its aggregator sends
+func collectUsage() (*UsageMeter, *UsageAggregator, *batchRecorder) {
+	r := newBatchRecorder()
+	a := NewUsageAggregator(time.Hour, 0, r.send)
+	return NewUsageMeter(0, a), a, r
+}
+
+func TestUsageMeterShortConnection(t *testing.T) {
+	m, a, r := collectUsage()
+	cu := m.Open(UserDataUsage{Username: "alice", DestinationHost: "a.example", BytesSent: 99})
+	cu.Add(10, false)
+	cu.Add(20, true)
+	cu.Close()
+	cu.Close()
+	a.Flush()
+
+	got, ok := r.records()["alice a.example "]
+	if !ok {
+		t.Fatalf("records = %v, want one without a connection ID", r.records())
+	}
+	if got.BytesSent != 10 || got.BytesReceived != 20 || got.Connections != 1 || got.Final {
+		t.Errorf("record = %+v, want 10 sent, 20 received, one connection", got)
+	}
+	if m.Active() != 0 {
+		t.Error("closed connection is still tracked")
+	}
+}
+
+func TestUsageMeterInterimDeltas(t *testing.T) {
+	m, a, r := collectUsage()
+	cu := m.Open(UserDataUsage{Username: "alice", DestinationHost: "a.example"})
+	id := cu.usage.ConnectionID
+
+	steps := []struct {
+		sent, received int
+		final          bool
+		wantSent       uint64
+		wantReceived   uint64
+		wantRecord     bool
+	}{
+		{100, 1000, false, 100, 1000, true},
+		{0, 0, false, 0, 0, false},
+		{5, 0, false, 5, 0, true},
+		{1, 2, true, 1, 2, true},
+	}
+	for i, s := range steps {
+		cu.Add(s.sent, false)
+		cu.Add(s.received, true)
+		if s.final {
+			cu.Close()
+		} else {
+			m.Report()
+		}
+		a.Flush()
+		r.mu.Lock()
+		batches := r.batches
+		r.batches = nil
+		r.mu.Unlock()
+		if !s.wantRecord {
+			if len(batches) != 0 {
+				t.Errorf("step %d: idle connection reported %+v", i, batches)
+			}
+			continue
+		}
+		if len(batches) != 1 || len(batches[0].Records) != 1 {
+			t.Fatalf("step %d: got batches %+v, want one record", i, batches)
+		}
+		got := batches[0].Records[0]
+		if got.ConnectionID != id || got.BytesSent != s.wantSent || got.BytesReceived != s.wantReceived || got.Final != s.final {
+			t.Errorf("step %d: record = %+v, want delta %d/%d final %v under %s", i, got, s.wantSent, s.wantReceived, s.final, id)
+		}
+		// interim records do not count the connection, its final record does
+		wantConnections := uint64(0)
+		if s.final {
+			wantConnections = 1
+		}
+		if got.Connections != wantConnections {
+			t.Errorf("step %d: record counts %d connections, want %d", i, got.Connections, wantConnections)
+		}
+	}
+}
+
+func TestUsageMeterStopReportsOpenConnections(t *testing.T) {
+	r := newBatchRecorder()
+	a := NewUsageAggregator(time.Hour, 0, r.send)
+	m := NewUsageMeter(time.Hour, a)
+	m.Start()
+	cu := m.Open(UserDataUsage{Username: "alice", DestinationHost: "a.example"})
+	cu.Add(42, false)
+	m.Stop()
+	a.Stop()
+
+	got := r.records()["alice a.example "+cu.usage.ConnectionID]
+	if got.BytesSent != 42 || got.Final {
+		t.Errorf("record = %+v, want an interim record of 42 bytes", got)
+	}
+	var nilUsage *ConnectionUsage
+	nilUsage.Add(1, true)
+	nilUsage.Close()
+}
@@ -0,0 +1,479 @@
+package manager
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// usageSpoolRetryInterval is how often batches still due are sent again
+	usageSpoolRetryInterval = 5 * time.Second
+	// usageSpoolAckTimeout resends a batch Captain did not acknowledge within this time
+	usageSpoolAckTimeout = time.Minute
+	// usageSpoolCompactAfter rewrites the spool file once it holds this many acknowledged records
+	usageSpoolCompactAfter = 1000
+	// usageSpoolMemoryBatches is how many spooled batches are kept in memory, older ones are read
+	// back from the spool file when they are sent
+	usageSpoolMemoryBatches = 100
+	// usageSpoolMaxMemoryOnly bounds the batches kept without a spool file, the oldest are dropped
+	usageSpoolMaxMemoryOnly = 10000
+)
+
+var errSpoolClosed = errors.New("spool file is not open")
+
+// spoolRecord is one line of the spool file, either a batch or an acknowledgement of
+// every batch of Epoch up to Seq
+type spoolRecord struct {
+	Epoch string      `json:"epoch"`
+	Seq   uint64      `json:"seq"`
+	Ack   bool        `json:"ack,omitempty"`
+	Batch *UsageBatch `json:"batch,omitempty"`
+}
+
+// spooledBatch is a batch waiting for Captain's acknowledgement
+type spooledBatch struct {
+	epoch  string
+	seq    uint64
+	batch  *UsageBatch // nil once evicted from memory, it is read back from the spool file
+	offset int64       // position of the batch record in the spool file
+	size   int64       // length of the batch record, zero while it is not on disk
+	sentAt time.Time
+}
+
+// UsageSpool is a write-ahead log of usage batches. Every batch gets the spool's epoch and
+// the next sequence number, is synced to disk before it is sent, and stays until Captain
+// acknowledges it, so usage survives Captain outages and worker restarts. The epoch is new
+// for every process, so sequence numbers that restart after a lost spool file never collide
+// with batches Captain already counted. Captain drops (worker, epoch, seq) it already
+// counted, which makes resending safe. Acknowledged batches are compacted away.
+// Only the latest batches are kept in memory, so a long outage costs disk space, not memory.
+type UsageSpool struct {
+	// Path of the spool file, empty keeps batches in memory only
+	Path string
+
+	epoch    string
+	pending  []*spooledBatch // in the order they were spooled
+	lastSeq  uint64
+	inMemory int   // pending batches whose body is in memory
+	stale    int   // acknowledged records still in the file
+	size     int64 // length of the spool file
+	file     *os.File
+	mu       sync.Mutex
+	wake     chan struct{}
+}
+
+// NewUsageSpool creates a spool writing to path
+func NewUsageSpool(path string) *UsageSpool {
+	return &UsageSpool{
+		Path:  path,
+		epoch: uuid.New().String(),
+		wake:  make(chan struct{}, 1),
+	}
+}
+
+// Enabled reports whether a spool file is configured
+func (s *UsageSpool) Enabled() bool {
+	return s.Path != ""
+}
+
+// Open loads the batches Captain did not acknowledge before the last shutdown and opens
+// the spool file for appending
+func (s *UsageSpool) Open() error {
+	if !s.Enabled() {
+		log.Println("[UsageSpool] No spool file, usage is lost on restart while Captain is unreachable")
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, err := os.OpenFile(s.Path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	s.file = f
+	if err := s.load(); err != nil {
+		s.pending = nil
+		s.file = nil
+		f.Close()
+		return err
+	}
+	if len(s.pending) > 0 {
+		log.Printf("[UsageSpool] Loaded %d unacknowledged usage batches from %s", len(s.pending), s.Path)
+		s.notify()
+	}
+	// rewrite at once, drops acknowledged batches and a record torn by a crash
+	return s.compact()
+}
+
+// load reads the batches not acknowledged yet, their bodies stay on disk until they are sent
+func (s *UsageSpool) load() error {
+	var batches []*spooledBatch
+	acked := make(map[string]uint64)
+	r := bufio.NewReader(s.file)
+	var offset int64
+	for line := 1; ; line++ {
+		data, err := r.ReadBytes('\n')
+		if len(data) > 0 {
+			var record spoolRecord
+			if e := json.Unmarshal(data, &record); e != nil {
+				log.Printf("[UsageSpool] Skipping unreadable record at line %d of %s: %v", line, s.Path, e)
+			} else {
+				switch {
+				case record.Ack && record.Seq > acked[record.Epoch]:
+					acked[record.Epoch] = record.Seq
+				case record.Batch != nil:
+					batches = append(batches, &spooledBatch{
+						epoch:  record.Epoch,
+						seq:    record.Seq,
+						offset: offset,
+						size:   int64(len(data)),
+					})
+				}
+			}
+			offset += int64(len(data))
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	s.size = offset
+	for _, p := range batches {
+		if p.seq > acked[p.epoch] {
+			s.pending = append(s.pending, p)
+		}
+	}
+	return nil
+}
+
+// Append assigns the next sequence number to batch and spools it until it is acknowledged.
+// An error means the batch could not be written to the spool file and was not spooled.
+func (s *UsageSpool) Append(batch UsageBatch) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastSeq++
+	batch.Epoch, batch.Seq = s.epoch, s.lastSeq
+	p := &spooledBatch{epoch: batch.Epoch, seq: batch.Seq, batch: &batch}
+	s.pending = append(s.pending, p)
+	s.inMemory++
+	if s.Enabled() {
+		var err error
+		if s.file == nil {
+			// the file could not be opened, rewriting it spools this batch too
+			err = s.compact()
+		} else {
+			p.offset, p.size, err = s.write(spoolRecord{Epoch: batch.Epoch, Seq: batch.Seq, Batch: &batch}, true)
+		}
+		if err != nil {
+			s.pending[len(s.pending)-1] = nil
+			s.pending = s.pending[:len(s.pending)-1]
+			s.inMemory--
+			return err
+		}
+		s.evict()
+	} else if len(s.pending) > usageSpoolMaxMemoryOnly {
+		dropped := s.pending[0]
+		s.pending[0] = nil
+		s.pending = s.pending[1:]
+		s.inMemory--
+		log.Printf("[UsageSpool] More than %d usage batches unacknowledged without a spool file, dropped batch %d", usageSpoolMaxMemoryOnly, dropped.seq)
+	}
+	s.notify()
+	return nil
+}
+
+// Ack drops every batch of epoch up to seq that was sent, Captain counted them, and returns
+// the dropped batches. Captain cannot have counted a batch it was never sent, those stay.
+// An empty epoch is the epoch of this process.
+func (s *UsageSpool) Ack(epoch string, seq uint64) (acked []UsageBatch) {
+	if epoch == "" {
+		epoch = s.epoch
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var highest uint64
+	removed := 0
+	kept := s.pending[:0]
+	for _, p := range s.pending {
+		if p.epoch != epoch || p.seq > seq || p.sentAt.IsZero() {
+			kept = append(kept, p)
+			continue
+		}
+		if batch, err := s.batchOf(p); err != nil {
+			log.Printf("[UsageSpool] Failed to read acknowledged usage batch %s/%d: %v", p.epoch, p.seq, err)
+		} else {
+			acked = append(acked, batch)
+		}
+		if p.batch != nil {
+			s.inMemory--
+		}
+		if p.seq > highest {
+			highest = p.seq
+		}
+		removed++
+	}
+	for i := len(kept); i < len(s.pending); i++ {
+		s.pending[i] = nil
+	}
+	s.pending = kept
+	if removed == 0 {
+		return
+	}
+	s.stale += removed
+	// an acknowledgement record drops every batch of the epoch up to its seq on load, it cannot
+	// express unsent batches below the highest acknowledged one, the file is rewritten instead
+	covered := false
+	for _, p := range s.pending {
+		if p.epoch == epoch && p.seq < highest {
+			covered = true
+			break
+		}
+	}
+	if !covered && len(s.pending) > 0 && s.stale < usageSpoolCompactAfter {
+		// not synced, a lost acknowledgement only resends batches Captain ignores
+		if _, _, err := s.write(spoolRecord{Epoch: epoch, Seq: highest, Ack: true}, false); err != nil {
+			log.Printf("[UsageSpool] Failed to record acknowledgement of batch %s/%d: %v", epoch, highest, err)
+		}
+		s.stale++
+		return
+	}
+	if err := s.compact(); err != nil {
+		log.Printf("[UsageSpool] Failed to compact %s: %v", s.Path, err)
+	}
+	return
+}
+
+// Rewind marks every unacknowledged batch as not sent, e.g. after reconnecting to Captain
+func (s *UsageSpool) Rewind() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, p := range s.pending {
+		p.sentAt = time.Time{}
+	}
+	if len(s.pending) > 0 {
+		s.notify()
+	}
+}
+
+// Due returns up to max batches not sent yet or not acknowledged in time, in the order they
+// were spooled
+func (s *UsageSpool) Due(now time.Time, max int) (batches []UsageBatch) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, p := range s.pending {
+		if len(batches) >= max {
+			break
+		}
+		if !p.sentAt.IsZero() && now.Sub(p.sentAt) < usageSpoolAckTimeout {
+			continue
+		}
+		batch, err := s.batchOf(p)
+		if err != nil {
+			log.Printf("[UsageSpool] Failed to read usage batch %s/%d: %v", p.epoch, p.seq, err)
+			continue
+		}
+		batches = append(batches, batch)
+	}
+	return
+}
+
+// MarkSent records that batch was handed to Captain
+func (s *UsageSpool) MarkSent(batch UsageBatch, at time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, p := range s.pending {
+		if p.epoch == batch.Epoch && p.seq == batch.Seq {
+			p.sentAt = at
+			return
+		}
+	}
+}
+
+// Pending returns the number of unacknowledged batches
+func (s *UsageSpool) Pending() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.pending)
+}
+
+func (s *UsageSpool) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// batchOf returns the batch of p, reading it from the spool file when it is not in memory
+func (s *UsageSpool) batchOf(p *spooledBatch) (UsageBatch, error) {
+	if p.batch != nil {
+		return *p.batch, nil
+	}
+	if s.file == nil {
+		return UsageBatch{}, errSpoolClosed
+	}
+	data := make([]byte, p.size)
+	if _, err := s.file.ReadAt(data, p.offset); err != nil {
+		return UsageBatch{}, err
+	}
+	var record spoolRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return UsageBatch{}, err
+	}
+	if record.Batch == nil || record.Epoch != p.epoch || record.Seq != p.seq {
+		return UsageBatch{}, fmt.Errorf("no batch %s/%d at offset %d", p.epoch, p.seq, p.offset)
+	}
+	batch := *record.Batch
+	batch.Epoch, batch.Seq = record.Epoch, record.Seq
+	return batch, nil
+}
+
+// evict drops the oldest batch bodies that are safely on disk once more than
+// usageSpoolMemoryBatches are in memory
+func (s *UsageSpool) evict() {
+	for _, p := range s.pending {
+		if s.inMemory <= usageSpoolMemoryBatches {
+			return
+		}
+		if p.batch != nil && p.size > 0 {
+			p.batch = nil
+			s.inMemory--
+		}
+	}
+}
+
+// write appends a record to the spool file, syncing it when sync is set, and returns where
+// it was written. A partly written record is cut off again.
+func (s *UsageSpool) write(record spoolRecord, sync bool) (offset, size int64, err error) {
+	if s.file == nil {
+		return 0, 0, errSpoolClosed
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return 0, 0, err
+	}
+	data = append(data, '\n')
+	offset = s.size
+	if n, err := s.file.Write(data); err != nil {
+		if n > 0 && s.file.Truncate(offset) != nil {
+			s.size += int64(n)
+		}
+		return 0, 0, err
+	}
+	if sync {
+		if err := s.file.Sync(); err != nil {
+			return 0, 0, err
+		}
+	}
+	s.size += int64(len(data))
+	return offset, int64(len(data)), nil
+}
+
+// compact replaces the spool file with the pending batches, through a temporary file so a
+// crash never leaves a half written spool behind
+func (s *UsageSpool) compact() error {
+	if !s.Enabled() {
+		return nil
+	}
+	tmp := s.Path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	offsets := make([]int64, len(s.pending))
+	sizes := make([]int64, len(s.pending))
+	var size int64
+	for i, p := range s.pending {
+		var batch UsageBatch
+		if batch, err = s.batchOf(p); err != nil {
+			break
+		}
+		var data []byte
+		if data, err = json.Marshal(spoolRecord{Epoch: p.epoch, Seq: p.seq, Batch: &batch}); err != nil {
+			break
+		}
+		if _, err = w.Write(append(data, '\n')); err != nil {
+			break
+		}
+		offsets[i], sizes[i] = size, int64(len(data))+1
+		size += sizes[i]
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		// the open temporary file becomes the spool file
+		err = os.Rename(tmp, s.Path)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if s.file != nil {
+		s.file.Close()
+	}
+	for i, p := range s.pending {
+		p.offset, p.size = offsets[i], sizes[i]
+	}
+	s.file, s.size, s.stale = f, size, 0
+	s.evict()
+	return nil
+}
+
+// sendSpooledUsage sends spooled usage batches to Captain in sequence order, whenever a
+// batch is added, after reconnecting and when an acknowledgement is overdue
+func (c *Worker) sendSpooledUsage() {
+	ticker := time.NewTicker(usageSpoolRetryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.Spool.wake:
+		}
+		if !c.Connected() {
+			continue
+		}
+	send:
+		// a few batches at a time, spooled ones are read back from disk
+		for due := c.Spool.Due(time.Now(), usageSpoolMemoryBatches); len(due) > 0; due = c.Spool.Due(time.Now(), usageSpoolMemoryBatches) {
+			for _, batch := range due {
+				if !c.send(Event{Type: "telemetry_usage_batch", Payload: batch}) {
+					log.Printf("[DataUsage] WebSocket not connected, %d usage batches spooled", c.Spool.Pending())
+					break send
+				}
+				c.Spool.MarkSent(batch, time.Now())
+				log.Printf("[DataUsage] Sent usage batch %d: %d records since %s", batch.Seq, len(batch.Records), batch.PeriodStart.Format(time.RFC3339))
+			}
+		}
+	}
+}
+
+// processUsageAck drops the usage batches Captain acknowledged and takes their bytes off
+// the quota counts, Captain's next remaining quota includes them
+func (c *Worker) processUsageAck(payload interface{}) {
+	data, _ := json.Marshal(payload)
+	var ack UsageAck
+	if err := json.Unmarshal(data, &ack); err != nil {
+		log.Printf("[Captain] Failed to parse usage_ack: %v", err)
+		return
+	}
+	for _, batch := range c.Spool.Ack(ack.Epoch, ack.Seq) {
+		for _, record := range batch.Records {
+			c.Quota.Acknowledge(record.Username, int64(record.BytesSent+record.BytesReceived))
+		}
+	}
+}
@@ -0,0 +1,230 @@
+package manager
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testBatch(username string) UsageBatch {
+	return UsageBatch{Records: []UsageRecord{{Username: username, BytesSent: 10, BytesReceived: 20}}}
+}
+
+// sendDue marks every due batch as sent, like the worker loop does
+func sendDue(s *UsageSpool) []UsageBatch {
+	due := s.Due(time.Now(), usageSpoolMemoryBatches)
+	for _, batch := range due {
+		s.MarkSent(batch, time.Now())
+	}
+	return due
+}
+
+func TestUsageSpoolSurvivesRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage.spool")
+	s := NewUsageSpool(path)
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	for _, user := range []string{"a", "b", "c"} {
+		s.Append(testBatch(user))
+	}
+	sent := sendDue(s)
+	if len(sent) != 3 || sent[0].Seq != 1 || sent[2].Seq != 3 || sent[0].Epoch != s.epoch {
+		t.Fatalf("due batches %+v, want seq 1 to 3 of the spool's epoch", sent)
+	}
+	if acked := s.Ack("", 2); len(acked) != 2 {
+		t.Fatalf("Ack dropped %d batches, want 2", len(acked))
+	}
+
+	restarted := NewUsageSpool(path)
+	if err := restarted.Open(); err != nil {
+		t.Fatal(err)
+	}
+	if restarted.epoch == s.epoch {
+		t.Fatal("a new process reused the epoch")
+	}
+	due := restarted.Due(time.Now(), usageSpoolMemoryBatches)
+	if len(due) != 1 || due[0].Seq != 3 || due[0].Epoch != s.epoch || due[0].Records[0].Username != "c" {
+		t.Fatalf("after restart due %+v, want only batch 3 of the old epoch", due)
+	}
+
+	// new batches restart their sequence in the new epoch without colliding
+	restarted.Append(testBatch("d"))
+	due = sendDue(restarted)
+	if len(due) != 2 || due[1].Seq != 1 || due[1].Epoch != restarted.epoch {
+		t.Fatalf("due %+v, want batch 1 of the new epoch after the old batch", due)
+	}
+	// acknowledging seq 3 of the new epoch must not drop batch 3 of the old one
+	if acked := restarted.Ack("", 3); len(acked) != 1 || acked[0].Records[0].Username != "d" {
+		t.Fatalf("Ack of the new epoch dropped %+v, want only batch d", acked)
+	}
+	if acked := restarted.Ack(s.epoch, 3); len(acked) != 1 || acked[0].Records[0].Username != "c" {
+		t.Fatalf("Ack of the old epoch dropped %+v, want only batch c", acked)
+	}
+	if n := restarted.Pending(); n != 0 {
+		t.Fatalf("%d batches pending, want 0", n)
+	}
+
+	// everything acknowledged compacts the file away
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 0 {
+		t.Errorf("spool file holds %q after every batch was acknowledged", data)
+	}
+}
+
+func TestUsageSpoolAckKeepsUnsentBatches(t *testing.T) {
+	s := NewUsageSpool("")
+	s.Append(testBatch("a"))
+	sendDue(s)
+	s.Append(testBatch("b"))
+	// a cumulative acknowledgement can cover batches Captain was never sent
+	if acked := s.Ack("", 10); len(acked) != 1 || acked[0].Seq != 1 {
+		t.Fatalf("Ack dropped %+v, want only the sent batch 1", acked)
+	}
+	if due := s.Due(time.Now(), usageSpoolMemoryBatches); len(due) != 1 || due[0].Seq != 2 {
+		t.Fatalf("due %+v, want the unsent batch 2", due)
+	}
+	if acked := s.Ack("another-epoch", 10); len(acked) != 0 {
+		t.Fatalf("Ack of another epoch dropped %+v", acked)
+	}
+}
+
+func TestUsageSpoolRewindAndTornRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage.spool")
+	s := NewUsageSpool(path)
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	s.Append(testBatch("a"))
+	sendDue(s)
+	if due := s.Due(time.Now(), usageSpoolMemoryBatches); len(due) != 0 {
+		t.Fatalf("sent batch due again before the ack timeout: %+v", due)
+	}
+	if due := s.Due(time.Now().Add(usageSpoolAckTimeout), usageSpoolMemoryBatches); len(due) != 1 {
+		t.Fatal("unacknowledged batch not due after the ack timeout")
+	}
+	s.Rewind()
+	if due := s.Due(time.Now(), usageSpoolMemoryBatches); len(due) != 1 {
+		t.Fatal("batch not due after Rewind")
+	}
+
+	// a crash in the middle of a write leaves a torn last line
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"epoch":"x","seq":7,"batch":{"rec`)
+	f.Close()
+
+	restarted := NewUsageSpool(path)
+	if err := restarted.Open(); err != nil {
+		t.Fatal(err)
+	}
+	if n := restarted.Pending(); n != 1 {
+		t.Fatalf("%d batches pending after loading a torn spool, want 1", n)
+	}
+}
+
+func TestUsageSpoolAckRecordNeverCoversUnsentBatches(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage.spool")
+	s := NewUsageSpool(path)
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	for _, user := range []string{"a", "b", "c", "d"} {
+		s.Append(testBatch(user))
+	}
+	sendDue(s)
+	// batch 2 was sent before a reconnect and is waiting to be sent again
+	s.MarkSent(UsageBatch{Epoch: s.epoch, Seq: 2}, time.Time{})
+	if acked := s.Ack("", 3); len(acked) != 2 {
+		t.Fatalf("Ack dropped %d batches, want 1 and 3", len(acked))
+	}
+
+	// a crash now must not lose batch 2
+	crashed := NewUsageSpool(path)
+	if err := crashed.Open(); err != nil {
+		t.Fatal(err)
+	}
+	var seqs []uint64
+	for _, batch := range crashed.Due(time.Now(), usageSpoolMemoryBatches) {
+		seqs = append(seqs, batch.Seq)
+	}
+	if len(seqs) != 2 || seqs[0] != 2 || seqs[1] != 4 {
+		t.Fatalf("after a crash the spool holds batches %v, want 2 and 4", seqs)
+	}
+}
+
+func TestUsageSpoolEvictsBatchesOnDisk(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage.spool")
+	s := NewUsageSpool(path)
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	total := 3 * usageSpoolMemoryBatches
+	for i := 0; i < total; i++ {
+		if err := s.Append(UsageBatch{Records: []UsageRecord{{Username: fmt.Sprint(i)}}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if s.inMemory > usageSpoolMemoryBatches {
+		t.Fatalf("%d batches in memory, want at most %d", s.inMemory, usageSpoolMemoryBatches)
+	}
+
+	// batches come back from disk in order, a limited number at a time
+	for sent := 0; sent < total; {
+		due := sendDue(s)
+		if len(due) == 0 || len(due) > usageSpoolMemoryBatches {
+			t.Fatalf("Due returned %d batches", len(due))
+		}
+		for _, batch := range due {
+			if want := fmt.Sprint(sent); batch.Records[0].Username != want || batch.Seq != uint64(sent+1) {
+				t.Fatalf("batch %d holds %q, want %q", batch.Seq, batch.Records[0].Username, want)
+			}
+			sent++
+		}
+	}
+	acked := s.Ack("", uint64(total))
+	if len(acked) != total || acked[0].Records[0].Username != "0" {
+		t.Fatalf("Ack returned %d batches, want %d read back from disk", len(acked), total)
+	}
+}
+
+func TestUsageSpoolAppendFailureIsNotSpooled(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage.spool")
+	s := NewUsageSpool(path)
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	s.Append(testBatch("a"))
+	readOnly, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.file.Close()
+	s.file = readOnly
+	if err := s.Append(testBatch("b")); err == nil {
+		t.Fatal("Append to a read-only spool file succeeded")
+	}
+	if n := s.Pending(); n != 1 {
+		t.Fatalf("%d batches pending, want only the one written", n)
+	}
+}
+
+func TestUsageSpoolMemoryOnlyIsBounded(t *testing.T) {
+	s := NewUsageSpool("")
+	for i := 0; i < usageSpoolMaxMemoryOnly+10; i++ {
+		s.Append(testBatch("a"))
+	}
+	if n := s.Pending(); n != usageSpoolMaxMemoryOnly {
+		t.Fatalf("%d batches pending, want %d", n, usageSpoolMaxMemoryOnly)
+	}
+	if due := s.Due(time.Now(), 1); due[0].Seq != 11 {
+		t.Fatalf("oldest pending batch is %d, want 11 after dropping the oldest 10", due[0].Seq)
+	}
+}
@@ -12,6 +12,7 @@ type WebsocketManager struct {
 	Worker     *Worker
 	Connection *websocket.Conn
 	egress     chan Event
+	done       chan struct{}
 }
 
 func NewWebsocketManager(worker *Worker, conn *websocket.Conn) *WebsocketManager {
@@ -19,12 +20,23 @@ func NewWebsocketManager(worker *Worker, conn *websocket.Conn) *WebsocketManager
 		Connection: conn,
 		Worker:     worker,
 		egress:     make(chan Event),
+		done:       make(chan struct{}),
+	}
+}
+
+// Send queues an event for Captain, it returns false once the connection is closed
+func (w *WebsocketManager) Send(event Event) bool {
+	select {
+	case w.egress <- event:
+		return true
+	case <-w.done:
+		return false
 	}
 }
 
 func (w *WebsocketManager) ReadMessage(wg *sync.WaitGroup) {
 	defer func() {
-		close(w.egress)
+		close(w.done)
 		w.Connection.Close()
 		wg.Done()
 	}()
@@ -56,7 +68,13 @@ func (w *WebsocketManager) WriteMessage(wg *sync.WaitGroup) {
 		wg.Done()
 	}()
 
-	for message := range w.egress {
+	for {
+		var message Event
+		select {
+		case message = <-w.egress:
+		case <-w.done:
+			return
+		}
 
 		if message.Type == "close" {
 			if err := w.Connection.WriteMessage(websocket.CloseMessage, nil); err != nil {
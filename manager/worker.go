@@ -2,12 +2,17 @@ package manager
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"net/url"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
@@ -25,30 +30,132 @@ type Worker struct {
 	mu                 sync.Mutex
 	reconnect          bool
 	pendingValidations sync.Map
-	Users              util.ConcurrentMap
-	Pool               *Pool
-	UpstreamManager    *UpstreamManager
-	HealthCollector    *HealthCollector
+	// inflightVerifications coalesces concurrent VerifyUser calls by credentials
+	inflightVerifications map[string]*verifyCall
+	verifyMu              sync.Mutex
+	Users                 util.ConcurrentMap
+	// pool is the *Pool from Captain's last config, swapped as a whole by processConfig
+	pool            atomic.Value
+	UpstreamManager *UpstreamManager
+	HealthCollector *HealthCollector
+	Sessions        *SessionManager
+	Prober          *UpstreamProber
+	UpstreamPools   *UpstreamPools
+	AuthCache       *util.AuthCache
+	OfflineAuth     *OfflineAuth
+	IPAuth          *util.IPAuthList
+	AuthGuard       *util.AuthGuard
+	Connections     *ConnectionLimiter
+	Bandwidth       *BandwidthLimiter
+	Quota           *QuotaTracker
+	Usage           *UsageAggregator
+	Spool           *UsageSpool
+	Meter           *UsageMeter
+	// notifications are events for Captain nobody waits for, dropped when the queue is full
+	notifications chan Event
+	dropped       uint64
+	stopOnce      sync.Once
 }
 
+// pendingValidation is a verify_user request waiting for Captain's answer
+type pendingValidation struct {
+	username string
+	// account is Captain's data for the user, set before a successful result is sent
+	account *User
+	result  chan bool
+}
+
+// verifyCall is a VerifyUser round trip shared by callers checking the same credentials
+type verifyCall struct {
+	done   chan struct{}
+	result bool
+	err    error
+}
+
+// verificationKey identifies a pair of credentials without keeping the password in memory
+func verificationKey(user, pass string) string {
+	sum := sha256.Sum256([]byte(user + ":" + pass))
+	return hex.EncodeToString(sum[:])
+}
+
+var (
+	errCaptainUnreachable = errors.New("captain is not connected")
+	errCaptainTimeout     = errors.New("captain did not answer in time")
+)
+
+// verifyUserTimeout is how long VerifyUser waits for Captain before using offline credentials
+const verifyUserTimeout = 5 * time.Second
+
+// notificationQueueSize bounds the events queued by notify
+const notificationQueueSize = 1024
+
 func NewWorker(baseURL, workerID, apiKey string) *Worker {
 	workerUUID, _ := uuid.Parse(workerID)
 	upstreamMgr := NewUpstreamManager()
-	return &Worker{
-		CaptainURL:      baseURL,
-		WorkerID:        workerID,
-		APIKey:          apiKey,
-		reconnect:       true,
-		Users:           util.NewConcurrentMap(),
-		UpstreamManager: upstreamMgr,
-		HealthCollector: NewHealthCollector(workerUUID, "", "", upstreamMgr),
+	c := &Worker{
+		CaptainURL:            baseURL,
+		WorkerID:              workerID,
+		APIKey:                apiKey,
+		reconnect:             true,
+		Users:                 util.NewConcurrentMap(),
+		inflightVerifications: make(map[string]*verifyCall),
+		notifications:         make(chan Event, notificationQueueSize),
+		UpstreamManager:       upstreamMgr,
+		HealthCollector:       NewHealthCollector(workerUUID, "", "", upstreamMgr),
+		Sessions:              NewSessionManager(),
+		Prober:                NewUpstreamProber(upstreamMgr, "", 0, 5000),
+		UpstreamPools:         NewUpstreamPools(upstreamMgr),
+		AuthCache:             util.NewAuthCache(DefaultAuthCacheTTL, DefaultAuthNegativeTTL),
+		OfflineAuth:           NewOfflineAuth("", apiKey, DefaultOfflineAuthMaxStale),
+		IPAuth:                util.NewIPAuthList(),
+		Connections:           NewConnectionLimiter(),
+		Bandwidth:             NewBandwidthLimiter(),
+		Quota:                 NewQuotaTracker(),
+		Spool:                 NewUsageSpool(""),
+		AuthGuard:             util.NewAuthGuard(DefaultAuthFailWindow, DefaultAuthFailIP, DefaultAuthFailUser, DefaultAuthBan),
 	}
+	c.AuthGuard.OnBan = c.reportAuthAbuse
+	c.Quota.OnExhausted = c.reportQuotaExhausted
+	c.Usage = NewUsageAggregator(DefaultUsageFlushInterval, DefaultUsageFlushSize, c.sendUsageBatch)
+	c.Meter = NewUsageMeter(DefaultUsageInterimInterval, c.Usage)
+	return c
 }
 
 func (c *Worker) Start() {
 	// Start the health collector for periodic sampling
 	c.HealthCollector.Start()
 
+	// Start expiring idle sticky sessions
+	c.Sessions.Start()
+
+	// Start active upstream probing when a probe target is configured
+	c.Prober.Start()
+
+	// Send rejections, bans and other notifications to Captain
+	go c.sendNotifications()
+
+	// Load the credentials used while Captain is unreachable
+	c.OfflineAuth.Start()
+
+	// Replay usage Captain did not acknowledge before the last shutdown, then start
+	// sending aggregated data usage
+	if err := c.Spool.Open(); err != nil {
+		log.Printf("[UsageSpool] Failed to open %s: %v", c.Spool.Path, err)
+	}
+	go c.sendSpooledUsage()
+	c.Usage.Start()
+	c.Meter.Start()
+
+	// Drop expired password check results, login failures and bans
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for range ticker.C {
+			c.AuthCache.Purge()
+			c.AuthGuard.Purge()
+		}
+	}()
+
 	// Start hourly health telemetry reporting
 	go func() {
 		ticker := time.NewTicker(1 * time.Hour)
@@ -72,6 +179,17 @@ func (c *Worker) Start() {
 	}()
 }
 
+// Stop saves the state that must survive a restart: usage of open connections and usage
+// aggregated since the last batch goes to the spool and changed offline credentials to disk. Calling it again does nothing
+func (c *Worker) Stop() {
+	c.stopOnce.Do(func() {
+		c.Meter.Stop()
+		c.Usage.Stop()
+		c.OfflineAuth.Stop()
+		log.Printf("[DataUsage] Flushed usage on shutdown, %d batches spooled for Captain", c.Spool.Pending())
+	})
+}
+
 func (c *Worker) Connect() error {
 	otp, err := c.login()
 	if err != nil {
@@ -116,6 +234,10 @@ func (c *Worker) Connect() error {
 
 	log.Println("[Captain] WebSocket connected successfully")
 
+	// tell Captain about logins decided while it was unreachable
+	go c.reportOfflineDecisions()
+	c.Spool.Rewind()
+
 	var wg sync.WaitGroup
 	wg.Add(2)
 	go c.WebsocketManager.ReadMessage(&wg)
@@ -163,6 +285,12 @@ func (c *Worker) HandleEvent(event Event) {
 		c.processConfig(event.Payload)
 	case "login_success":
 		c.processVerifyUserResponse(event.Payload)
+	case "user_update":
+		c.processUserUpdate(event.Payload)
+	case "user_delete":
+		c.processUserDelete(event.Payload)
+	case "usage_ack":
+		c.processUsageAck(event.Payload)
 	case "error":
 		log.Printf("[Captain] Error from server: %v", event.Payload)
 	default:
@@ -170,52 +298,134 @@ func (c *Worker) HandleEvent(event Event) {
 	}
 }
 
-func (c *Worker) VerifyUser(user, pass string) bool {
-	respChan := make(chan bool)
+// VerifyUser asks Captain whether user and pass are valid. Concurrent checks of the same
+// credentials share one round trip. err is set when Captain could not answer, ok then comes
+// from the offline credentials and is not a decision of Captain.
+func (c *Worker) VerifyUser(user, pass string) (ok bool, err error) {
+	key := verificationKey(user, pass)
+
+	c.verifyMu.Lock()
+	if call, found := c.inflightVerifications[key]; found {
+		c.verifyMu.Unlock()
+		<-call.done
+		return call.result, call.err
+	}
+	call := &verifyCall{done: make(chan struct{})}
+	c.inflightVerifications[key] = call
+	c.verifyMu.Unlock()
 
-	c.pendingValidations.Store(user, respChan)
-	defer c.pendingValidations.Delete(user)
+	result, err := c.verifyUser(user, pass)
+	if err != nil {
+		log.Printf("[Captain] %v, checking %s against offline credentials", err, user)
+		result = c.verifyOffline(user, pass)
+	}
+	call.result, call.err = result, err
+
+	c.verifyMu.Lock()
+	delete(c.inflightVerifications, key)
+	c.verifyMu.Unlock()
+	close(call.done)
+	return call.result, call.err
+}
+
+// verifyUser sends one verify_user request and waits for the login_success carrying its
+// request ID, err is set when Captain could not be reached
+func (c *Worker) verifyUser(user, pass string) (ok bool, err error) {
+	requestID := uuid.New().String()
+	pending := &pendingValidation{username: user, result: make(chan bool, 1)}
+
+	c.pendingValidations.Store(requestID, pending)
+	defer c.pendingValidations.Delete(requestID)
 
 	payload := map[string]string{
-		"username": user,
-		"password": pass,
+		"request_id": requestID,
+		"username":   user,
+		"password":   pass,
 	}
 
-	c.WebsocketManager.egress <- Event{Type: "verify_user", Payload: payload}
+	if !c.send(Event{Type: "verify_user", Payload: payload}) {
+		return false, errCaptainUnreachable
+	}
 
 	select {
-	case result := <-respChan:
-		return result
-	case <-time.After(5 * time.Second):
-		log.Printf("[Captain] VerifyUser timeout for %s", user)
+	case ok = <-pending.result:
+		// a wrong password, possibly from someone else, must not erase the user's offline
+		// credentials, only an account that is no longer active does
+		if ok && strings.EqualFold(pending.account.Status, UserStatusActive) {
+			c.OfflineAuth.Remember(user, pass, *pending.account)
+		} else if ok {
+			c.OfflineAuth.Forget(user)
+		}
+		return ok, nil
+	case <-time.After(verifyUserTimeout):
+		log.Printf("[Captain] VerifyUser timeout for %s (request: %s)", user, requestID)
+		return false, errCaptainTimeout
+	}
+}
+
+// verifyOffline checks a login against the offline credentials while Captain is unreachable
+func (c *Worker) verifyOffline(user, pass string) bool {
+	account, err := c.OfflineAuth.Verify(user, pass)
+	if err != nil {
+		log.Printf("[OfflineAuth] Login of %s refused: %v", user, err)
 		return false
 	}
+	c.Users.Set(user, account)
+	// the cached quota is stale, it only applies to users without a count yet
+	c.Bandwidth.Update(user, account.UploadRate, account.DownloadRate)
+	c.Quota.Init(user, account.QuotaRemaining)
+	log.Printf("[OfflineAuth] Login of %s accepted from offline credentials", user)
+	return true
 }
 
 func (c *Worker) processVerifyUserResponse(payload interface{}) {
 	data, _ := json.Marshal(payload)
 	var resp struct {
-		Success bool        `json:"success"`
-		Payload UserPayload `json:"payload"`
+		RequestID string      `json:"request_id"`
+		Success   bool        `json:"success"`
+		Payload   UserPayload `json:"payload"`
 	}
 	if err := json.Unmarshal(data, &resp); err != nil {
 		log.Printf("[Captain] Failed to parse verify_user_response: %v", err)
 		return
 	}
 
-	if ch, ok := c.pendingValidations.Load(resp.Payload.Username); ok {
-		ch.(chan bool) <- resp.Success
-		if resp.Success {
-			user := &User{
-				ID:          resp.Payload.ID,
-				Status:      resp.Payload.Status,
-				IpWhitelist: resp.Payload.IpWhitelist,
-				Pools:       resp.Payload.Pools,
-			}
-			c.Users.Set(resp.Payload.Username, user)
-			return
+	pending := c.takePendingValidation(resp.RequestID, resp.Payload.Username)
+	if pending == nil {
+		log.Printf("[Captain] No pending verification for request %q (user: %s)", resp.RequestID, resp.Payload.Username)
+		return
+	}
+	if resp.Success {
+		user := userFromPayload(resp.Payload)
+		c.Users.Set(pending.username, &user)
+		c.applyUserLimits(pending.username, &user)
+		pending.account = &user
+	}
+	pending.result <- resp.Success
+}
+
+// takePendingValidation removes and returns the verification a response answers. Responses
+// from a Captain that does not echo request IDs are matched to a verification of the username.
+func (c *Worker) takePendingValidation(requestID, username string) (pending *pendingValidation) {
+	if requestID != "" {
+		if item, ok := c.pendingValidations.LoadAndDelete(requestID); ok {
+			return item.(*pendingValidation)
 		}
+		return nil
 	}
+	if username == "" {
+		return nil
+	}
+	c.pendingValidations.Range(func(key, item interface{}) bool {
+		if item.(*pendingValidation).username == username {
+			if _, ok := c.pendingValidations.LoadAndDelete(key); ok {
+				pending = item.(*pendingValidation)
+			}
+			return false
+		}
+		return true
+	})
+	return
 }
 
 func (c *Worker) processConfig(payload interface{}) {
@@ -236,51 +446,114 @@ func (c *Worker) processConfig(payload interface{}) {
 			UpstreamHost:     upstream.UpstreamHost,
 			UpstreamPort:     int(upstream.UpstreamPort),
 			UpstreamProvider: upstream.UpstreamProvider,
+			UpstreamCountry:  upstream.UpstreamCountry,
 			Weight:           upstream.Weight,
 		})
 	}
-	c.Pool = NewPool(config.PoolID, config.PoolTag, config.PoolPort, config.PoolSubdomain, upstreams)
+	pool := NewPool(config.PoolID, config.PoolTag, config.PoolPort, config.PoolSubdomain, upstreams)
+	pool.MaxConnectionsPerUser = config.MaxConnectionsPerUser
+	pool.Region = "" // Region will be set when Captain provides it
+	c.pool.Store(pool)
 
-	// Update the UpstreamManager with the new upstreams for round-robin load balancing
+	// Update the UpstreamManager with the new upstreams and the pool's selection strategy
+	c.UpstreamManager.SetStrategy(config.SelectionStrategy)
 	c.UpstreamManager.SetUpstreams(upstreams)
 
+	// Users authenticated by source ip need no verify_user round trip
+	ipAuthUsers := make(map[string]bool)
+	for _, payload := range config.IpAuthUsers {
+		user := userFromPayload(payload)
+		user.IpAuth = true
+		c.Users.Set(payload.Username, &user)
+		c.applyUserLimits(payload.Username, &user)
+		ipAuthUsers[payload.Username] = true
+	}
+	for username, item := range c.Users.Items() {
+		if item.(*User).IpAuth && !ipAuthUsers[username] {
+			c.Users.Remove(username)
+		}
+	}
+	c.rebuildIPAuth()
+
 	// Update worker name and region in health collector
 	c.WorkerName = config.WorkerName
-	c.Pool.Region = "" // Region will be set when Captain provides it
-	c.HealthCollector.UpdateWorkerInfo(config.WorkerName, c.Pool.Region)
+	c.HealthCollector.UpdateWorkerInfo(config.WorkerName, pool.Region)
 
 	log.Printf("[Captain] Configuration received for Pool: %s (Port: %d)", config.PoolTag, config.PoolPort)
 	log.Printf("[Captain] Upstreams count: %d", len(config.Upstreams))
 }
 
+// CurrentPool returns the pool from Captain's last config, nil before the first one
+func (c *Worker) CurrentPool() *Pool {
+	pool, _ := c.pool.Load().(*Pool)
+	return pool
+}
+
 // GetPoolInfo returns the current pool ID and name
 func (c *Worker) GetPoolInfo() (poolID, poolName string) {
-	if c.Pool != nil {
-		return c.Pool.PoolId.String(), c.Pool.PoolTag
+	if pool := c.CurrentPool(); pool != nil {
+		return pool.PoolId.String(), pool.PoolTag
 	}
 	return "", ""
 }
 
-// SendDataUsage sends a user data usage event to Captain via WebSocket
-func (c *Worker) SendDataUsage(usage UserDataUsage) {
-	if c.WebsocketManager == nil {
-		log.Printf("[DataUsage] WebSocket not connected, cannot send data usage")
-		return
+// GetPoolRegion returns the current pool region, empty before the first config
+func (c *Worker) GetPoolRegion() string {
+	if pool := c.CurrentPool(); pool != nil {
+		return pool.Region
 	}
+	return ""
+}
 
-	event := Event{
-		Type:    "telemetry_usage",
-		Payload: usage,
+// Connected reports whether the WebSocket to Captain is up
+func (c *Worker) Connected() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.WebsocketManager != nil
+}
+
+// send queues an event for Captain, it returns false when the WebSocket is not connected
+func (c *Worker) send(event Event) bool {
+	c.mu.Lock()
+	wm := c.WebsocketManager
+	c.mu.Unlock()
+	if wm == nil {
+		return false
 	}
+	return wm.Send(event)
+}
 
-	c.WebsocketManager.egress <- event
-	log.Printf("[DataUsage] Sent usage: user=%s, bytes_sent=%d, bytes_received=%d, dest=%s:%d",
-		usage.Username, usage.BytesSent, usage.BytesReceived, usage.DestinationHost, usage.DestinationPort)
+// notify queues an event for Captain without blocking the caller, the event is dropped
+// when the queue is full, e.g. during a flood of rejected logins
+func (c *Worker) notify(event Event) {
+	select {
+	case c.notifications <- event:
+	default:
+		if n := atomic.AddUint64(&c.dropped, 1); n == 1 || n%1000 == 0 {
+			log.Printf("[Captain] Notification queue full, dropped %d events", n)
+		}
+	}
+}
+
+// sendNotifications sends the events queued by notify one at a time
+func (c *Worker) sendNotifications() {
+	for event := range c.notifications {
+		if !c.send(event) {
+			log.Printf("[Captain] WebSocket not connected, cannot send %s", event.Type)
+		}
+	}
+}
+
+// SendDataUsage queues the usage of a closed connection for the next usage batch to Captain,
+// it never blocks on the WebSocket
+func (c *Worker) SendDataUsage(usage UserDataUsage) {
+	usage.Final = true
+	c.Usage.Add(usage)
 }
 
 // SendHealthTelemetry sends worker health telemetry to Captain via WebSocket
 func (c *Worker) SendHealthTelemetry() {
-	if c.WebsocketManager == nil {
+	if !c.Connected() {
 		log.Printf("[HealthTelemetry] WebSocket not connected, cannot send health telemetry")
 		return
 	}
@@ -291,7 +564,10 @@ func (c *Worker) SendHealthTelemetry() {
 		Payload: health,
 	}
 
-	c.WebsocketManager.egress <- event
+	if !c.send(event) {
+		log.Printf("[HealthTelemetry] WebSocket not connected, cannot send health telemetry")
+		return
+	}
 	log.Printf("[HealthTelemetry] Sent health: status=%s, cpu=%.2f%%, mem=%.2f%%, active_conns=%d, throughput=%d bytes/sec",
 		health.Status, health.CpuUsage, health.MemoryUsage, health.ActiveConnections, health.BytesThroughputPerSec)
 }
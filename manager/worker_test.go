@@ -0,0 +1,58 @@
+package manager
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestTakePendingValidation(t *testing.T) {
+	c := NewWorker("http://127.0.0.1:1", uuid.New().String(), "key")
+	alice := &pendingValidation{username: "alice", result: make(chan bool, 1)}
+	bob := &pendingValidation{username: "bob", result: make(chan bool, 1)}
+	c.pendingValidations.Store("req-alice", alice)
+	c.pendingValidations.Store("req-bob", bob)
+
+	tests := []struct {
+		name      string
+		requestID string
+		username  string
+		want      *pendingValidation
+	}{
+		{"unknown request id", "req-carol", "alice", nil},
+		{"by request id", "req-bob", "alice", bob},
+		{"request id answered once", "req-bob", "bob", nil},
+		{"username fallback", "", "alice", alice},
+		{"username fallback answered once", "", "alice", nil},
+		{"nothing to match", "", "", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := c.takePendingValidation(tt.requestID, tt.username); got != tt.want {
+				t.Errorf("takePendingValidation(%q, %q) = %v, want %v", tt.requestID, tt.username, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProcessVerifyUserResponse(t *testing.T) {
+	c := NewWorker("http://127.0.0.1:1", uuid.New().String(), "key")
+	pending := &pendingValidation{username: "alice", result: make(chan bool, 1)}
+	c.pendingValidations.Store("req-1", pending)
+
+	id := uuid.New()
+	c.processVerifyUserResponse(map[string]interface{}{
+		"request_id": "req-1",
+		"success":    true,
+		"payload":    map[string]interface{}{"id": id.String(), "username": "alice", "status": "active"},
+	})
+	if ok := <-pending.result; !ok {
+		t.Fatal("result = false, want true")
+	}
+	if pending.account == nil || pending.account.ID != id {
+		t.Fatalf("account = %+v, want the user sent by Captain", pending.account)
+	}
+	if item, ok := c.Users.Get("alice"); !ok || item.(*User).ID != id {
+		t.Error("user was not stored under the name it was verified with")
+	}
+}
@@ -57,11 +57,15 @@ type HTTPArgs struct {
 	Direct              *string
 	AuthFile            *string
 	Auth                *[]string
+	IPAuthFile          *string
 	ParentType          *string
 	LocalType           *string
 	Timeout             *int
 	PoolSize            *int
+	UpstreamPoolSize    *int
 	CheckParentInterval *int
+	UpstreamAttempts    *int
+	UpstreamDeadline    *int
 }
 
 type SOCKSArgs struct {
@@ -73,11 +77,15 @@ type SOCKSArgs struct {
 	Direct              *string
 	AuthFile            *string
 	Auth                *[]string
+	IPAuthFile          *string
 	ParentType          *string
 	LocalType           *string
 	Timeout             *int
 	PoolSize            *int
+	UpstreamPoolSize    *int
 	CheckParentInterval *int
+	UpstreamAttempts    *int
+	UpstreamDeadline    *int
 }
 
 type UDPArgs struct {
@@ -12,8 +12,6 @@ import (
 	"runtime/debug"
 	"strconv"
 	"strings"
-	"sync/atomic"
-	"time"
 
 	"github.com/google/uuid"
 	"github.com/snail007/goproxy/manager"
@@ -26,6 +24,7 @@ type HTTP struct {
 	checker   utils.Checker
 	basicAuth utils.BasicAuth
 	worker    *manager.Worker
+	watchers  []*utils.FileWatcher
 }
 
 func NewHTTP() Service {
@@ -40,12 +39,25 @@ func (s *HTTP) InitService() {
 	s.InitBasicAuth()
 	if s.worker.UpstreamManager == nil || !s.worker.UpstreamManager.HasUpstreams() {
 		s.checker = utils.NewChecker(*s.cfg.HTTPTimeout, int64(*s.cfg.Interval), *s.cfg.Blocked, *s.cfg.Direct)
+		s.watchers = append(s.watchers,
+			utils.WatchFile(*s.cfg.Blocked, utils.FileWatchInterval, s.checker.ReloadBlocked),
+			utils.WatchFile(*s.cfg.Direct, utils.FileWatchInterval, s.checker.ReloadDirect))
 	}
 }
 func (s *HTTP) StopService() {
+	for _, w := range s.watchers {
+		w.Stop()
+	}
+	s.watchers = nil
 	if s.outPool.Pool != nil {
 		s.outPool.Pool.ReleaseAll()
 	}
+	if s.worker != nil && s.worker.UpstreamPools != nil {
+		s.worker.UpstreamPools.Stop()
+	}
+	if s.worker != nil {
+		s.worker.Stop()
+	}
 }
 func (s *HTTP) Start(args interface{}, worker *manager.Worker) (err error) {
 	s.cfg = args.(HTTPArgs)
@@ -59,10 +71,18 @@ func (s *HTTP) Start(args interface{}, worker *manager.Worker) (err error) {
 
 	s.InitService()
 	s.basicAuth.Validator = worker.VerifyUser
+	s.basicAuth.Authorizer = worker.AuthorizeUser
+	s.basicAuth.Cache = worker.AuthCache
+	s.basicAuth.IPAuthenticator = worker.AuthenticateIP
+	s.basicAuth.Guard = worker.AuthGuard
+
+	// keep warm connections to every upstream Captain configures
+	worker.UpstreamPools.Start(*s.cfg.UpstreamPoolSize, *s.cfg.Timeout)
 
 	host, port, _ := net.SplitHostPort(*s.cfg.Local)
 	p, _ := strconv.Atoi(port)
 	sc := utils.NewServerChannel(host, p)
+	sc.SetAcceptFilter(s.acceptFilter)
 	if *s.cfg.LocalType == TYPE_TCP {
 		err = sc.ListenTCP(s.callback)
 	} else {
@@ -75,6 +95,12 @@ func (s *HTTP) Start(args interface{}, worker *manager.Worker) (err error) {
 	return
 }
 
+// acceptFilter drops connections from sources banned for failed logins
+func (s *HTTP) acceptFilter(conn net.Conn) bool {
+	ip, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	return !s.basicAuth.Guard.Banned(ip)
+}
+
 func (s *HTTP) Clean() {
 	s.StopService()
 }
@@ -124,6 +150,27 @@ func (s *HTTP) OutToTCP(useProxy bool, address string, inConn *net.Conn, req *ut
 	inAddr := (*inConn).RemoteAddr().String()
 	inLocalAddr := (*inConn).LocalAddr().String()
 
+	// Count the connection against the user's limit until the tunnel closes
+	releaseConn, err := s.worker.AcquireConnection(req.User.Username)
+	if err != nil {
+		fmt.Fprintf(*inConn, "HTTP/1.1 429 Too Many Requests\r\nContent-Length: %d\r\n\r\n%s", len(err.Error()), err)
+		utils.CloseConn(inConn)
+		return
+	}
+	bound := false
+	defer func() {
+		if !bound {
+			releaseConn()
+		}
+	}()
+	// Refuse users whose data quota ran out
+	quota, err := s.worker.CheckQuota(req.User.Username)
+	if err != nil {
+		fmt.Fprintf(*inConn, "HTTP/1.1 403 Forbidden\r\nContent-Length: %d\r\n\r\n%s", len(err.Error()), err)
+		utils.CloseConn(inConn)
+		return
+	}
+
 	if s.IsDeadLoop(inLocalAddr, req.Host) {
 		utils.CloseConn(inConn)
 		err = fmt.Errorf("dead loop detected , %s", req.Host)
@@ -135,45 +182,24 @@ func (s *HTTP) OutToTCP(useProxy bool, address string, inConn *net.Conn, req *ut
 	var currentUpstream *manager.Upstream
 
 	if useProxy {
-		// Try to get upstream from manager (round-robin)
-		if s.worker.UpstreamManager != nil && s.worker.UpstreamManager.HasUpstreams() {
-			upstream := s.worker.UpstreamManager.Next()
-			if upstream != nil {
-				currentUpstream = upstream
-				upstreamAddr := upstream.GetAddress()
-				upstreamUser = upstream.UpstreamUsername
-				upstreamPass = upstream.UpstreamPassword
-				log.Printf("[Upstream] Connecting to: %s (tag: %s)", upstreamAddr, upstream.UpstreamTag)
-
-				// Measure connection latency for upstream health tracking
-				connectStart := time.Now()
-				outConn, err = utils.ConnectHost(upstreamAddr, *s.cfg.Timeout)
-				connectLatency := time.Since(connectStart)
-
-				// Record upstream latency in health collector
-				if s.worker != nil && s.worker.HealthCollector != nil {
-					s.worker.HealthCollector.RecordUpstreamLatency(
-						upstream.UpstreamID,
-						upstream.UpstreamTag,
-						connectLatency,
-						err != nil,
-					)
-				}
-			} else {
-				err = fmt.Errorf("no upstream available")
-			}
-		} else {
-			err = fmt.Errorf("no upstream configured")
+		// Try upstreams from manager (weighted round-robin), moving on to the next one when a dial fails.
+		// Nothing has been written to the client yet, so retrying is transparent.
+		outConn, currentUpstream, err = dialUpstream(s.worker, req.User, req.Host, false, *s.cfg.Timeout, *s.cfg.UpstreamAttempts, *s.cfg.UpstreamDeadline)
+		if currentUpstream != nil {
+			upstreamUser = currentUpstream.UpstreamUsername
+			upstreamPass = currentUpstream.UpstreamPassword
 		}
 	} else {
 		outConn, err = utils.ConnectHost(address, *s.cfg.Timeout)
 	}
 
-	// Store current upstream for error tracking on connection close
-	_ = currentUpstream // Will be used for per-request upstream error tracking if needed
-
 	if err != nil {
-		log.Printf("connect to %s , err:%s", "", err)
+		log.Printf("connect to %s , err:%s", address, err)
+		if refused, ok := utils.IsTargetRefused(err); ok {
+			fmt.Fprintf(*inConn, "HTTP/1.1 %s\r\nContent-Length: %d\r\n\r\n%s", refused.HTTPStatus(), len(err.Error()), err)
+		} else if err == manager.ErrNoMatchingUpstream {
+			fmt.Fprintf(*inConn, "HTTP/1.1 502 Bad Gateway\r\nContent-Length: %d\r\n\r\n%s", len(err.Error()), err)
+		}
 		utils.CloseConn(inConn)
 		return
 	}
@@ -181,7 +207,10 @@ func (s *HTTP) OutToTCP(useProxy bool, address string, inConn *net.Conn, req *ut
 	outAddr := outConn.RemoteAddr().String()
 	outLocalAddr := outConn.LocalAddr().String()
 
-	if req.IsHTTPS() && !useProxy {
+	// SOCKS5 upstreams hand back a tunnel to the target, like a direct connection
+	tunneled := currentUpstream != nil && currentUpstream.Protocol() == manager.UpstreamProtocolSOCKS5
+
+	if req.IsHTTPS() && (!useProxy || tunneled) {
 		req.HTTPSReply()
 	} else {
 		httpReq, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(req.HeadBuf)))
@@ -191,22 +220,24 @@ func (s *HTTP) OutToTCP(useProxy bool, address string, inConn *net.Conn, req *ut
 		}
 		httpReq.Header.Del("Proxy-Authorization")
 
-		// Use upstream credentials if available
-		if upstreamUser != "" && upstreamPass != "" {
-			token := base64.StdEncoding.EncodeToString([]byte(upstreamUser + ":" + upstreamPass))
-			httpReq.Header.Set("Proxy-Authorization", "Basic "+token)
-			log.Printf("[Upstream] Using credentials for user: %s", upstreamUser)
-		}
-
 		var buf bytes.Buffer
-		httpReq.WriteProxy(&buf)
+		if tunneled {
+			httpReq.Header.Del("Proxy-Connection")
+			httpReq.Write(&buf)
+		} else {
+			// Use upstream credentials if available
+			if upstreamUser != "" && upstreamPass != "" {
+				token := base64.StdEncoding.EncodeToString([]byte(upstreamUser + ":" + upstreamPass))
+				httpReq.Header.Set("Proxy-Authorization", "Basic "+token)
+				log.Printf("[Upstream] Using credentials for user: %s", upstreamUser)
+			}
+			httpReq.WriteProxy(&buf)
+		}
 		outConn.Write(buf.Bytes())
 	}
 
 	// Data usage tracking
-	var bytesSent uint64
-	var bytesReceived uint64
-	username := req.GetBasicAuthUser()
+	username := req.User.Username
 	sourceIP := strings.Split(inAddr, ":")[0]
 
 	// Parse destination host and port
@@ -226,9 +257,55 @@ func (s *HTTP) OutToTCP(useProxy bool, address string, inConn *net.Conn, req *ut
 	if s.worker != nil && s.worker.HealthCollector != nil {
 		s.worker.HealthCollector.IncrementConnection()
 	}
+	// Count the tunnel on its upstream for least-connections selection
+	if currentUpstream != nil {
+		s.worker.UpstreamManager.Acquire(currentUpstream.UpstreamID)
+	}
+
+	// Reads from the upstream are the user's download, reads from the client its upload
+	uploadLimiter, downloadLimiter := s.worker.UserLimiters(req.User.Username)
+
+	// Count the bytes against the user's quota, which closes the tunnel once it runs out
+	unregisterQuota := func() {}
+	if quota != nil {
+		unregisterQuota = quota.Register(*inConn)
+	}
+
+	// Count the bytes for data usage, reported to Captain while the tunnel is open and on close
+	var meter *manager.ConnectionUsage
+	if s.worker != nil {
+		poolID, poolName := s.worker.GetPoolInfo()
+		workerUUID, _ := uuid.Parse(s.worker.WorkerID)
+		poolUUID, _ := uuid.Parse(poolID)
 
-	utils.IoBind((*inConn), outConn, func(isSrcErr bool, err error) {
+		usage := manager.UserDataUsage{
+			UserID:          uuid.Nil,
+			Username:        username,
+			PoolID:          poolUUID,
+			PoolName:        poolName,
+			WorkerID:        workerUUID,
+			WorkerRegion:    s.worker.GetPoolRegion(),
+			SourceIP:        sourceIP,
+			Protocol:        "HTTP",
+			DestinationHost: destHost,
+			DestinationPort: destPort,
+			StatusCode:      200, // Default success
+		}
+		if req.IsHTTPS() {
+			usage.Protocol = "HTTPS"
+		}
+		meter = s.worker.MeterUsage(usage)
+	}
+
+	bound = true
+	utils.IoBindLimited((*inConn), outConn, func(isSrcErr bool, err error) {
 		log.Printf("conn %s - %s - %s -%s released [%s]", inAddr, inLocalAddr, outLocalAddr, outAddr, req.Host)
+		releaseConn()
+		unregisterQuota()
+
+		if currentUpstream != nil {
+			s.worker.UpstreamManager.Release(currentUpstream.UpstreamID)
+		}
 
 		// Decrement connection count
 		if s.worker != nil && s.worker.HealthCollector != nil {
@@ -241,48 +318,22 @@ func (s *HTTP) OutToTCP(useProxy bool, address string, inConn *net.Conn, req *ut
 			}
 		}
 
-		// Send data usage to Captain when connection closes
-		if s.worker != nil && (bytesSent > 0 || bytesReceived > 0) {
-			poolID, poolName := s.worker.GetPoolInfo()
-			workerUUID, _ := uuid.Parse(s.worker.WorkerID)
-			poolUUID, _ := uuid.Parse(poolID)
-
-			usage := manager.UserDataUsage{
-				UserID:          uuid.Nil,
-				Username:        username,
-				PoolID:          poolUUID,
-				PoolName:        poolName,
-				WorkerID:        workerUUID,
-				WorkerRegion:    s.worker.Pool.Region,
-				BytesSent:       atomic.LoadUint64(&bytesSent),
-				BytesReceived:   atomic.LoadUint64(&bytesReceived),
-				SourceIP:        sourceIP,
-				Protocol:        "HTTP",
-				DestinationHost: destHost,
-				DestinationPort: destPort,
-				StatusCode:      200, // Default success
-			}
-			if req.IsHTTPS() {
-				usage.Protocol = "HTTPS"
-			}
-
-			s.worker.SendDataUsage(usage)
-		}
+		// Send the final data usage to Captain when connection closes
+		meter.Close()
 
 		utils.CloseConn(inConn)
 		utils.CloseConn(&outConn)
 	}, func(n int, isDownload bool) {
-		// Track bytes transferred
-		if isDownload {
-			atomic.AddUint64(&bytesReceived, uint64(n))
-		} else {
-			atomic.AddUint64(&bytesSent, uint64(n))
+		if quota != nil {
+			quota.Add(n)
 		}
+		// Track bytes transferred
+		meter.Add(n, isDownload)
 		// Track throughput in HealthCollector
 		if s.worker != nil && s.worker.HealthCollector != nil {
 			s.worker.HealthCollector.AddThroughput(uint64(n))
 		}
-	}, 0)
+	}, downloadLimiter, uploadLimiter)
 	log.Printf("conn %s - %s - %s - %s connected [%s]", inAddr, inLocalAddr, outLocalAddr, outAddr, req.Host)
 	return
 
@@ -316,13 +367,47 @@ func (s *HTTP) InitBasicAuth() (err error) {
 			return
 		}
 		log.Printf("auth data added from file %d , total:%d", n, s.basicAuth.Total())
+		s.watchers = append(s.watchers, utils.WatchFile(*s.cfg.AuthFile, utils.FileWatchInterval, s.reloadAuthFile))
 	}
 	if len(*s.cfg.Auth) > 0 {
 		n := s.basicAuth.Add(*s.cfg.Auth)
 		log.Printf("auth data added %d, total:%d", n, s.basicAuth.Total())
 	}
+	if *s.cfg.IPAuthFile != "" {
+		s.basicAuth.IPList = utils.NewIPAuthList()
+		var n = 0
+		n, err = s.basicAuth.IPList.LoadFile(*s.cfg.IPAuthFile)
+		if err != nil {
+			err = fmt.Errorf("ip-auth-file ERR:%s", err)
+			log.Println(err)
+			return
+		}
+		log.Printf("ip auth data added from file %d", n)
+		s.watchers = append(s.watchers, utils.WatchFile(*s.cfg.IPAuthFile, utils.FileWatchInterval, s.reloadIPAuthFile))
+	}
 	return
 }
+
+// reloadAuthFile swaps in the users of the changed auth file, on error the old users are kept
+func (s *HTTP) reloadAuthFile() {
+	added, removed, changed, err := s.basicAuth.ReloadFile(*s.cfg.AuthFile)
+	if err != nil {
+		log.Printf("auth-file reload ERR:%s, keeping %d users", err, s.basicAuth.Total())
+		return
+	}
+	log.Printf("auth file reloaded , total:%d, added:%d, removed:%d, changed:%d", s.basicAuth.Total(), added, removed, changed)
+}
+
+// reloadIPAuthFile swaps in the entries of the changed ip auth file, on error the old entries are kept
+func (s *HTTP) reloadIPAuthFile() {
+	n, err := s.basicAuth.IPList.LoadFile(*s.cfg.IPAuthFile)
+	if err != nil {
+		log.Printf("ip-auth-file reload ERR:%s, keeping %d entries", err, s.basicAuth.IPList.Len())
+		return
+	}
+	log.Printf("ip auth file reloaded , entries:%d", n)
+}
+
 func (s *HTTP) IsBasicAuth() bool {
 	return *s.cfg.AuthFile != "" || len(*s.cfg.Auth) > 0
 }
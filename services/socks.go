@@ -9,6 +9,7 @@ import (
 	"runtime/debug"
 	"strconv"
 
+	"github.com/google/uuid"
 	"github.com/snail007/goproxy/manager"
 	"github.com/snail007/goproxy/utils"
 )
@@ -50,12 +51,29 @@ type SOCKS struct {
 	checker   utils.Checker
 	basicAuth utils.BasicAuth
 	worker    *manager.Worker
+	watchers  []*utils.FileWatcher
 }
 
-func (s *SOCKS) SetValidator(validator func(string, string) bool) {
+func (s *SOCKS) SetValidator(validator func(user, pass string) (bool, error)) {
 	s.basicAuth.Validator = validator
 }
 
+func (s *SOCKS) SetAuthorizer(authorizer func(user, ip string) error) {
+	s.basicAuth.Authorizer = authorizer
+}
+
+func (s *SOCKS) SetAuthCache(cache *utils.AuthCache) {
+	s.basicAuth.Cache = cache
+}
+
+func (s *SOCKS) SetAuthGuard(guard *utils.AuthGuard) {
+	s.basicAuth.Guard = guard
+}
+
+func (s *SOCKS) SetIPAuthenticator(authenticator func(ip string) (string, bool)) {
+	s.basicAuth.IPAuthenticator = authenticator
+}
+
 func NewSOCKS() Service {
 	return &SOCKS{
 		outPool:   utils.OutPool{},
@@ -70,14 +88,27 @@ func (s *SOCKS) InitService() {
 	if s.worker.UpstreamManager == nil || !s.worker.UpstreamManager.HasUpstreams() {
 
 		s.checker = utils.NewChecker(*s.cfg.HTTPTimeout, int64(*s.cfg.Interval), *s.cfg.Blocked, *s.cfg.Direct)
+		s.watchers = append(s.watchers,
+			utils.WatchFile(*s.cfg.Blocked, utils.FileWatchInterval, s.checker.ReloadBlocked),
+			utils.WatchFile(*s.cfg.Direct, utils.FileWatchInterval, s.checker.ReloadDirect))
 
 	}
 }
 
 func (s *SOCKS) StopService() {
+	for _, w := range s.watchers {
+		w.Stop()
+	}
+	s.watchers = nil
 	if s.outPool.Pool != nil {
 		s.outPool.Pool.ReleaseAll()
 	}
+	if s.worker != nil && s.worker.UpstreamPools != nil {
+		s.worker.UpstreamPools.Stop()
+	}
+	if s.worker != nil {
+		s.worker.Stop()
+	}
 }
 
 func (s *SOCKS) Start(args interface{}, worker *manager.Worker) (err error) {
@@ -91,10 +122,18 @@ func (s *SOCKS) Start(args interface{}, worker *manager.Worker) (err error) {
 
 	s.InitService()
 	s.SetValidator(worker.VerifyUser)
+	s.SetAuthorizer(worker.AuthorizeUser)
+	s.SetAuthCache(worker.AuthCache)
+	s.SetIPAuthenticator(worker.AuthenticateIP)
+	s.SetAuthGuard(worker.AuthGuard)
+
+	// keep warm connections to every upstream Captain configures
+	worker.UpstreamPools.Start(*s.cfg.UpstreamPoolSize, *s.cfg.Timeout)
 
 	host, port, _ := net.SplitHostPort(*s.cfg.Local)
 	p, _ := strconv.Atoi(port)
 	sc := utils.NewServerChannel(host, p)
+	sc.SetAcceptFilter(s.acceptFilter)
 	if *s.cfg.LocalType == TYPE_TCP {
 		err = sc.ListenTCP(s.callback)
 	} else {
@@ -107,6 +146,12 @@ func (s *SOCKS) Start(args interface{}, worker *manager.Worker) (err error) {
 	return
 }
 
+// acceptFilter drops connections from sources banned for failed logins
+func (s *SOCKS) acceptFilter(conn net.Conn) bool {
+	ip, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	return !s.basicAuth.Guard.Banned(ip)
+}
+
 func (s *SOCKS) Clean() {
 	s.StopService()
 }
@@ -119,7 +164,7 @@ func (s *SOCKS) callback(inConn net.Conn) {
 	}()
 
 	// Handle SOCKS5 handshake
-	err := s.handleHandshake(&inConn)
+	user, err := s.handleHandshake(&inConn)
 	if err != nil {
 		log.Printf("socks5 handshake error from %s: %s", inConn.RemoteAddr(), err)
 		utils.CloseConn(&inConn)
@@ -134,115 +179,150 @@ func (s *SOCKS) callback(inConn net.Conn) {
 		return
 	}
 
-	useProxy := true
-	if s.worker.UpstreamManager == nil || !s.worker.UpstreamManager.HasUpstreams() {
-		useProxy = false
+	// Determine if we should use upstream proxy
+	useProxy := false
+	if s.worker.UpstreamManager != nil && s.worker.UpstreamManager.HasUpstreams() {
+		useProxy = true
 	} else if *s.cfg.Always {
 		useProxy = true
 	} else {
 		s.checker.Add(address, true, "CONNECT", "", nil)
 		useProxy, _, _ = s.checker.IsBlocked(address)
 	}
-	log.Printf("use proxy : %v, %s", useProxy, address)
+	log.Printf("use proxy : %v, %s, user: %s", useProxy, address, user.Username)
 
-	err = s.OutToTCP(useProxy, address, &inConn)
+	err = s.OutToTCP(useProxy, address, &inConn, user)
 	if err != nil {
 		if s.worker.UpstreamManager == nil || !s.worker.UpstreamManager.HasUpstreams() {
 			log.Printf("connect to %s fail, ERR:%s", address, err)
 		} else {
-			log.Printf("connect to %s parent %s fail", *s.cfg.ParentType, "")
+			log.Printf("connect to %s through upstream fail, ERR:%s", address, err)
 		}
 		utils.CloseConn(&inConn)
 	}
 }
 
-func (s *SOCKS) handleHandshake(inConn *net.Conn) error {
+func (s *SOCKS) handleHandshake(inConn *net.Conn) (user utils.UserParams, err error) {
 	// Read version and number of auth methods
 	header := make([]byte, 2)
-	if _, err := io.ReadFull(*inConn, header); err != nil {
-		return fmt.Errorf("failed to read header: %w", err)
+	if _, err = io.ReadFull(*inConn, header); err != nil {
+		err = fmt.Errorf("failed to read header: %w", err)
+		return
 	}
 
 	if header[0] != SOCKS5_VERSION {
-		return fmt.Errorf("unsupported SOCKS version: %d", header[0])
+		err = fmt.Errorf("unsupported SOCKS version: %d", header[0])
+		return
 	}
 
 	// Read auth methods
 	numMethods := int(header[1])
 	methods := make([]byte, numMethods)
-	if _, err := io.ReadFull(*inConn, methods); err != nil {
-		return fmt.Errorf("failed to read auth methods: %w", err)
+	if _, err = io.ReadFull(*inConn, methods); err != nil {
+		err = fmt.Errorf("failed to read auth methods: %w", err)
+		return
 	}
 
-	// Require username/password auth
-	hasPasswordAuth := false
+	// Prefer username/password auth, it can carry session parameters
+	hasPasswordAuth, hasNoAuth := false, false
 	for _, m := range methods {
-		if m == SOCKS5_AUTH_PASSWORD {
+		switch m {
+		case SOCKS5_AUTH_PASSWORD:
 			hasPasswordAuth = true
-			break
+		case SOCKS5_AUTH_NONE:
+			hasNoAuth = true
 		}
 	}
 	if !hasPasswordAuth {
+		// clients of ip authenticated users send no credentials
+		if hasNoAuth {
+			clientIP, _, _ := net.SplitHostPort((*inConn).RemoteAddr().String())
+			if ipUser, ok := s.basicAuth.AuthenticateIP(clientIP); ok {
+				user = utils.UserParams{Username: ipUser}
+				if authErr := s.basicAuth.Authorize(user.Username, clientIP); authErr != nil {
+					(*inConn).Write([]byte{SOCKS5_VERSION, SOCKS5_AUTH_NO_ACCEPT})
+					err = fmt.Errorf("ip auth user %s refused: %s", user.Username, authErr)
+					return
+				}
+				log.Printf("socks5 ip auth success for user: %s", user.Username)
+				(*inConn).Write([]byte{SOCKS5_VERSION, SOCKS5_AUTH_NONE})
+				return
+			}
+		}
 		(*inConn).Write([]byte{SOCKS5_VERSION, SOCKS5_AUTH_NO_ACCEPT})
-		return fmt.Errorf("client doesn't support password auth")
+		err = fmt.Errorf("client doesn't support password auth")
+		return
 	}
 
 	// Request password auth
 	(*inConn).Write([]byte{SOCKS5_VERSION, SOCKS5_AUTH_PASSWORD})
 
 	// Handle password auth
-	if err := s.handlePasswordAuth(inConn); err != nil {
-		return err
-	}
+	user, err = s.handlePasswordAuth(inConn)
 
 	// No auth required
 	//(*inConn).Write([]byte{SOCKS5_VERSION, SOCKS5_AUTH_NONE})
 
-	return nil
+	return
 }
 
-func (s *SOCKS) handlePasswordAuth(inConn *net.Conn) error {
+// handlePasswordAuth runs the RFC 1929 username/password sub-negotiation and returns the
+// authenticated user with any session parameters from its username
+func (s *SOCKS) handlePasswordAuth(inConn *net.Conn) (user utils.UserParams, err error) {
 	// Read auth version
 	header := make([]byte, 2)
-	if _, err := io.ReadFull(*inConn, header); err != nil {
-		return fmt.Errorf("failed to read auth header: %w", err)
+	if _, err = io.ReadFull(*inConn, header); err != nil {
+		err = fmt.Errorf("failed to read auth header: %w", err)
+		return
 	}
 
 	// auth version should be 0x01
 	if header[0] != 0x01 {
-		return fmt.Errorf("unsupported auth version: %d", header[0])
+		err = fmt.Errorf("unsupported auth version: %d", header[0])
+		return
 	}
 
 	// Read username
 	usernameLen := int(header[1])
 	username := make([]byte, usernameLen)
-	if _, err := io.ReadFull(*inConn, username); err != nil {
-		return fmt.Errorf("failed to read username: %w", err)
+	if _, err = io.ReadFull(*inConn, username); err != nil {
+		err = fmt.Errorf("failed to read username: %w", err)
+		return
 	}
 
 	// Read password length
 	passLenByte := make([]byte, 1)
-	if _, err := io.ReadFull(*inConn, passLenByte); err != nil {
-		return fmt.Errorf("failed to read password length: %w", err)
+	if _, err = io.ReadFull(*inConn, passLenByte); err != nil {
+		err = fmt.Errorf("failed to read password length: %w", err)
+		return
 	}
 
 	// Read password
 	passwordLen := int(passLenByte[0])
 	password := make([]byte, passwordLen)
-	if _, err := io.ReadFull(*inConn, password); err != nil {
-		return fmt.Errorf("failed to read password: %w", err)
+	if _, err = io.ReadFull(*inConn, password); err != nil {
+		err = fmt.Errorf("failed to read password: %w", err)
+		return
 	}
 
-	// Validate credentials
-	userpass := fmt.Sprintf("%s:%s", string(username), string(password))
-	if !s.basicAuth.Check(userpass) {
+	// Validate credentials of the base username, the rest of it carries session parameters
+	user = utils.ParseUserParams(string(username))
+	userpass := fmt.Sprintf("%s:%s", user.Username, string(password))
+	clientIP, _, _ := net.SplitHostPort((*inConn).RemoteAddr().String())
+	if !s.basicAuth.CheckFrom(userpass, clientIP) {
 		(*inConn).Write([]byte{0x01, 0x01}) // Auth failed
-		return fmt.Errorf("authentication failed for user: %s", string(username))
+		err = fmt.Errorf("authentication failed for user: %s", user.Username)
+		return
+	}
+	if authErr := s.basicAuth.Authorize(user.Username, clientIP); authErr != nil {
+		(*inConn).Write([]byte{0x01, 0x01}) // Auth failed
+		err = fmt.Errorf("user %s refused: %s", user.Username, authErr)
+		return
 	}
 
-	log.Printf("socks5 auth success for user: %s", string(username))
+	log.Printf("socks5 auth success for user: %s", user.Username)
 	(*inConn).Write([]byte{0x01, 0x00}) // Auth success
-	return nil
+	return
 }
 
 func (s *SOCKS) handleRequest(inConn *net.Conn) (string, error) {
@@ -319,22 +399,48 @@ func (s *SOCKS) sendReply(inConn *net.Conn, rep byte) {
 	(*inConn).Write(reply)
 }
 
-func (s *SOCKS) OutToTCP(useProxy bool, address string, inConn *net.Conn) (err error) {
+func (s *SOCKS) OutToTCP(useProxy bool, address string, inConn *net.Conn, user utils.UserParams) (err error) {
 	inAddr := (*inConn).RemoteAddr().String()
 	inLocalAddr := (*inConn).LocalAddr().String()
 
+	// Count the connection against the user's limit until the tunnel closes
+	releaseConn, err := s.worker.AcquireConnection(user.Username)
+	if err != nil {
+		s.sendReply(inConn, SOCKS5_REP_CONN_NOT_ALLOWED)
+		utils.CloseConn(inConn)
+		return
+	}
+	bound := false
+	defer func() {
+		if !bound {
+			releaseConn()
+		}
+	}()
+	// Refuse users whose data quota ran out
+	quota, err := s.worker.CheckQuota(user.Username)
+	if err != nil {
+		s.sendReply(inConn, SOCKS5_REP_CONN_NOT_ALLOWED)
+		utils.CloseConn(inConn)
+		return
+	}
+
 	var outConn net.Conn
-	var _outConn interface{}
+	var currentUpstream *manager.Upstream
 	if useProxy {
-		_outConn, err = s.outPool.Pool.Get()
-		if err == nil {
-			outConn = _outConn.(net.Conn)
-		}
+		// Open a tunnel to the target through upstreams from manager, with an HTTP CONNECT
+		// or SOCKS5 handshake depending on the upstream, moving on to the next one when it fails
+		outConn, currentUpstream, err = dialUpstream(s.worker, user, address, true, *s.cfg.Timeout, *s.cfg.UpstreamAttempts, *s.cfg.UpstreamDeadline)
 	} else {
 		outConn, err = utils.ConnectHost(address, *s.cfg.Timeout)
 	}
 	if err != nil {
-		s.sendReply(inConn, SOCKS5_REP_HOST_UNREACHABLE)
+		if refused, ok := utils.IsTargetRefused(err); ok {
+			s.sendReply(inConn, refused.SocksReply())
+		} else if err == manager.ErrNoMatchingUpstream {
+			s.sendReply(inConn, SOCKS5_REP_NET_UNREACHABLE)
+		} else {
+			s.sendReply(inConn, SOCKS5_REP_HOST_UNREACHABLE)
+		}
 		log.Printf("connect to %s , err:%s", address, err)
 		utils.CloseConn(inConn)
 		return
@@ -350,9 +456,54 @@ func (s *SOCKS) OutToTCP(useProxy bool, address string, inConn *net.Conn) (err e
 	if s.worker != nil && s.worker.HealthCollector != nil {
 		s.worker.HealthCollector.IncrementConnection()
 	}
-
-	utils.IoBind((*inConn), outConn, func(isSrcErr bool, err error) {
+	// Count the tunnel on its upstream for least-connections selection
+	if currentUpstream != nil {
+		s.worker.UpstreamManager.Acquire(currentUpstream.UpstreamID)
+	}
+
+	// Reads from the upstream are the user's download, reads from the client its upload
+	uploadLimiter, downloadLimiter := s.worker.UserLimiters(user.Username)
+
+	// Count the bytes against the user's quota, which closes the tunnel once it runs out
+	unregisterQuota := func() {}
+	if quota != nil {
+		unregisterQuota = quota.Register(*inConn)
+	}
+
+	// Count the bytes for data usage, reported to Captain while the tunnel is open and on close
+	var meter *manager.ConnectionUsage
+	if s.worker != nil {
+		poolID, poolName := s.worker.GetPoolInfo()
+		workerUUID, _ := uuid.Parse(s.worker.WorkerID)
+		poolUUID, _ := uuid.Parse(poolID)
+		sourceIP, _, _ := net.SplitHostPort(inAddr)
+		destHost, destPortStr, _ := net.SplitHostPort(address)
+		destPort, _ := strconv.Atoi(destPortStr)
+
+		meter = s.worker.MeterUsage(manager.UserDataUsage{
+			UserID:          uuid.Nil,
+			Username:        user.Username,
+			PoolID:          poolUUID,
+			PoolName:        poolName,
+			WorkerID:        workerUUID,
+			WorkerRegion:    s.worker.GetPoolRegion(),
+			SourceIP:        sourceIP,
+			Protocol:        "SOCKS5",
+			DestinationHost: destHost,
+			DestinationPort: uint16(destPort),
+			StatusCode:      200, // Default success
+		})
+	}
+
+	bound = true
+	utils.IoBindLimited((*inConn), outConn, func(isSrcErr bool, err error) {
 		log.Printf("conn %s - %s - %s -%s released [%s]", inAddr, inLocalAddr, outLocalAddr, outAddr, address)
+		releaseConn()
+		unregisterQuota()
+
+		if currentUpstream != nil {
+			s.worker.UpstreamManager.Release(currentUpstream.UpstreamID)
+		}
 
 		// Decrement connection count
 		if s.worker != nil && s.worker.HealthCollector != nil {
@@ -365,14 +516,22 @@ func (s *SOCKS) OutToTCP(useProxy bool, address string, inConn *net.Conn) (err e
 			}
 		}
 
+		// Send the final data usage to Captain when connection closes
+		meter.Close()
+
 		utils.CloseConn(inConn)
 		utils.CloseConn(&outConn)
-	}, func(n int, d bool) {
+	}, func(n int, isDownload bool) {
+		if quota != nil {
+			quota.Add(n)
+		}
+		// Track bytes transferred
+		meter.Add(n, isDownload)
 		// Track throughput in HealthCollector
 		if s.worker != nil && s.worker.HealthCollector != nil {
 			s.worker.HealthCollector.AddThroughput(uint64(n))
 		}
-	}, 0)
+	}, downloadLimiter, uploadLimiter)
 	log.Printf("conn %s - %s - %s - %s connected [%s]", inAddr, inLocalAddr, outLocalAddr, outAddr, address)
 	return
 }
@@ -401,14 +560,47 @@ func (s *SOCKS) InitBasicAuth() (err error) {
 			return
 		}
 		log.Printf("auth data added from file %d , total:%d", n, s.basicAuth.Total())
+		s.watchers = append(s.watchers, utils.WatchFile(*s.cfg.AuthFile, utils.FileWatchInterval, s.reloadAuthFile))
 	}
 	if len(*s.cfg.Auth) > 0 {
 		n := s.basicAuth.Add(*s.cfg.Auth)
 		log.Printf("auth data added %d, total:%d", n, s.basicAuth.Total())
 	}
+	if *s.cfg.IPAuthFile != "" {
+		s.basicAuth.IPList = utils.NewIPAuthList()
+		var n = 0
+		n, err = s.basicAuth.IPList.LoadFile(*s.cfg.IPAuthFile)
+		if err != nil {
+			err = fmt.Errorf("ip-auth-file ERR:%s", err)
+			log.Println(err)
+			return
+		}
+		log.Printf("ip auth data added from file %d", n)
+		s.watchers = append(s.watchers, utils.WatchFile(*s.cfg.IPAuthFile, utils.FileWatchInterval, s.reloadIPAuthFile))
+	}
 	return
 }
 
+// reloadAuthFile swaps in the users of the changed auth file, on error the old users are kept
+func (s *SOCKS) reloadAuthFile() {
+	added, removed, changed, err := s.basicAuth.ReloadFile(*s.cfg.AuthFile)
+	if err != nil {
+		log.Printf("auth-file reload ERR:%s, keeping %d users", err, s.basicAuth.Total())
+		return
+	}
+	log.Printf("auth file reloaded , total:%d, added:%d, removed:%d, changed:%d", s.basicAuth.Total(), added, removed, changed)
+}
+
+// reloadIPAuthFile swaps in the entries of the changed ip auth file, on error the old entries are kept
+func (s *SOCKS) reloadIPAuthFile() {
+	n, err := s.basicAuth.IPList.LoadFile(*s.cfg.IPAuthFile)
+	if err != nil {
+		log.Printf("ip-auth-file reload ERR:%s, keeping %d entries", err, s.basicAuth.IPList.Len())
+		return
+	}
+	log.Printf("ip auth file reloaded , entries:%d", n)
+}
+
 func (s *SOCKS) IsBasicAuth() bool {
 	return *s.cfg.AuthFile != "" || len(*s.cfg.Auth) > 0
 }
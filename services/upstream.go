@@ -0,0 +1,172 @@
+package services
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/snail007/goproxy/manager"
+	"github.com/snail007/goproxy/utils"
+)
+
+// dialUpstream selects an upstream from the worker and connects to it. When a dial fails the
+// next upstream is tried, until attempts dials were made or deadline milliseconds have passed.
+// When an upstream answers that it cannot reach target, its *utils.TargetRefusedError is
+// returned at once without trying others.
+// Every attempt is recorded in the HealthCollector, only dial, TLS, handshake and proxy
+// authentication errors count as failures of the upstream.
+// If the user asked for a sticky session the pinned upstream is tried first, and the session
+// is pinned to whichever upstream finally connects.
+// SOCKS5 upstreams, and HTTP upstreams when tunnel is set, get a handshake to target as part of
+// the attempt, so the returned connection is a tunnel to target. Otherwise the connection talks
+// to the HTTP proxy itself.
+// Upstreams are restricted to the user's country, tag and provider targeting, and
+// manager.ErrNoMatchingUpstream is returned when no configured upstream matches it. Upstreams
+// without a country serve country targeting when none is known to be in that country.
+func dialUpstream(worker *manager.Worker, user utils.UserParams, target string, tunnel bool, timeout, attempts, deadline int) (outConn net.Conn, upstream *manager.Upstream, err error) {
+	if worker == nil || worker.UpstreamManager == nil || !worker.UpstreamManager.HasUpstreams() {
+		err = fmt.Errorf("no upstream configured")
+		return
+	}
+	if attempts < 1 {
+		attempts = 1
+	}
+	matches := func(u *manager.Upstream) bool {
+		return u.Matches(user.Country, user.Tag, user.Provider)
+	}
+	if user.Country != "" && !worker.UpstreamManager.HasMatch(matches) {
+		// Captain may not send upstream countries yet, an upstream without one is of unknown
+		// country and used when no upstream is known to be in the requested one
+		matches = func(u *manager.Upstream) bool {
+			return u.UpstreamCountry == "" && u.Matches("", user.Tag, user.Provider)
+		}
+	}
+	if user.HasTargeting() && !worker.UpstreamManager.HasMatch(matches) {
+		log.Printf("[Upstream] No upstream matches country=%q tag=%q provider=%q", user.Country, user.Tag, user.Provider)
+		err = manager.ErrNoMatchingUpstream
+		return
+	}
+
+	var sessionKey string
+	var pinnedID uuid.UUID
+	var pinned bool
+	if user.Session != "" && worker.Sessions != nil {
+		sessionKey = manager.SessionKey(user.Username, user.Session)
+		pinnedID, pinned = worker.Sessions.Get(sessionKey)
+	}
+
+	start := time.Now()
+	tried := make(map[uuid.UUID]bool)
+	for i := 0; i < attempts; i++ {
+		dialTimeout := timeout
+		if deadline > 0 {
+			remaining := deadline - int(time.Since(start)/time.Millisecond)
+			if remaining <= 0 {
+				break
+			}
+			if remaining < dialTimeout {
+				dialTimeout = remaining
+			}
+		}
+
+		upstream = nil
+		if pinned && i == 0 {
+			upstream = worker.UpstreamManager.Pinned(pinnedID, matches)
+			if upstream == nil {
+				log.Printf("[Upstream] Session %s upstream %s is unavailable, selecting a new one", sessionKey, pinnedID)
+			}
+		}
+		if upstream == nil {
+			upstream = worker.UpstreamManager.NextWhere(func(u *manager.Upstream) bool {
+				return !tried[u.UpstreamID] && matches(u)
+			})
+		}
+		if upstream == nil {
+			break
+		}
+		tried[upstream.UpstreamID] = true
+
+		upstreamAddr := upstream.GetAddress()
+		log.Printf("[Upstream] Connecting to: %s (tag: %s, attempt: %d/%d)", upstreamAddr, upstream.UpstreamTag, i+1, attempts)
+
+		// Measure connection latency for upstream health tracking
+		connectStart := time.Now()
+		var pooled bool
+		outConn, pooled, err = connectUpstream(worker, upstream, target, tunnel, dialTimeout)
+		connectLatency := time.Since(connectStart)
+
+		// Record upstream latency in health collector, a target the upstream could not reach
+		// is no failure of the upstream. A warm connection skipped the dial, its latency would
+		// make the upstream look faster than it is, so only its breaker learns the outcome
+		_, refused := utils.IsTargetRefused(err)
+		if pooled {
+			worker.UpstreamManager.ReportOutcome(upstream.UpstreamID, false)
+		} else if worker.HealthCollector != nil {
+			worker.HealthCollector.RecordUpstreamLatency(
+				upstream.UpstreamID,
+				upstream.UpstreamTag,
+				connectLatency,
+				err != nil && !refused,
+			)
+		}
+		if err == nil {
+			if sessionKey != "" {
+				worker.Sessions.Pin(sessionKey, upstream.UpstreamID, time.Duration(user.SessionTime)*time.Minute)
+			}
+			return
+		}
+		log.Printf("[Upstream] Connect to %s failed: %s", upstreamAddr, err)
+		if refused {
+			// another upstream would not reach the target either
+			upstream = nil
+			return
+		}
+	}
+	if len(tried) == 0 {
+		err = fmt.Errorf("no upstream available")
+	} else {
+		err = fmt.Errorf("all %d upstream attempts failed, last ERR:%s", len(tried), err)
+	}
+	upstream = nil
+	return
+}
+
+// connectUpstream takes a warm connection to an upstream from the worker's pools or dials it
+// with its protocol and, for SOCKS5 upstreams or when tunnel is set, opens a tunnel to target
+// through it. pooled is set when a warm connection was used.
+func connectUpstream(worker *manager.Worker, upstream *manager.Upstream, target string, tunnel bool, timeout int) (conn net.Conn, pooled bool, err error) {
+	tunnel = tunnel || upstream.Protocol() == manager.UpstreamProtocolSOCKS5
+	if worker.UpstreamPools != nil {
+		if warm, ok := worker.UpstreamPools.Get(upstream.UpstreamID); ok {
+			if !tunnel {
+				return warm, true, nil
+			}
+			if err = upstream.Tunnel(warm, target, timeout); err == nil {
+				return warm, true, nil
+			}
+			if _, refused := utils.IsTargetRefused(err); refused {
+				// the upstream answered, a fresh dial would be refused the same way
+				utils.CloseConn(&warm)
+				return nil, true, err
+			}
+			// the warm connection may have gone stale, fall back to a fresh dial
+			log.Printf("[Upstream] Pooled connection to %s failed: %s", upstream.GetAddress(), err)
+			utils.CloseConn(&warm)
+		}
+	}
+
+	conn, err = upstream.Dial(timeout)
+	if err != nil {
+		return
+	}
+	if tunnel {
+		err = upstream.Tunnel(conn, target, timeout)
+	}
+	if err != nil {
+		utils.CloseConn(&conn)
+		conn = nil
+	}
+	return
+}
@@ -0,0 +1,239 @@
+package services
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/snail007/goproxy/manager"
+	"github.com/snail007/goproxy/utils"
+)
+
+// fakeUpstream is an HTTP proxy answering every CONNECT with status
+type fakeUpstream struct {
+	manager.Upstream
+	accepted int32
+}
+
+func newFakeUpstream(t *testing.T, status string) *fakeUpstream {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	addr := l.Addr().(*net.TCPAddr)
+	u := &fakeUpstream{Upstream: manager.Upstream{
+		UpstreamID:   uuid.New(),
+		UpstreamHost: "127.0.0.1",
+		UpstreamPort: addr.Port,
+		Weight:       1,
+	}}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&u.accepted, 1)
+			t.Cleanup(func() { conn.Close() })
+			go func() {
+				r := bufio.NewReader(conn)
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					if line == "\r\n" {
+						conn.Write([]byte("HTTP/1.1 " + status + "\r\n\r\n"))
+					}
+				}
+			}()
+		}
+	}()
+	return u
+}
+
+// deadUpstream is an upstream nothing listens on
+func deadUpstream(t *testing.T) manager.Upstream {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+	return manager.Upstream{UpstreamID: uuid.New(), UpstreamHost: "127.0.0.1", UpstreamPort: port, Weight: 1}
+}
+
+func testWorker(upstreams ...manager.Upstream) *manager.Worker {
+	worker := manager.NewWorker("http://127.0.0.1:1", uuid.New().String(), "key")
+	worker.UpstreamManager.SetUpstreams(upstreams)
+	return worker
+}
+
+func TestDialUpstreamRetriesNextUpstream(t *testing.T) {
+	dead := deadUpstream(t)
+	dead.Weight = 10
+	live := newFakeUpstream(t, "200 Connection established")
+	worker := testWorker(dead, live.Upstream)
+
+	conn, upstream, err := dialUpstream(worker, utils.UserParams{}, "example.com:443", true, 1000, 3, 0)
+	if err != nil {
+		t.Fatalf("dialUpstream: %v", err)
+	}
+	conn.Close()
+	if upstream.UpstreamID != live.UpstreamID {
+		t.Fatalf("connected through %s, want the live upstream", upstream.GetAddress())
+	}
+}
+
+func TestDialUpstreamGivesUp(t *testing.T) {
+	tests := []struct {
+		name      string
+		upstreams int
+		attempts  int
+		want      string
+	}{
+		{"attempts", 3, 2, "all 2 upstream attempts failed"},
+		{"upstreams", 2, 5, "all 2 upstream attempts failed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var upstreams []manager.Upstream
+			for i := 0; i < tt.upstreams; i++ {
+				upstreams = append(upstreams, deadUpstream(t))
+			}
+			conn, upstream, err := dialUpstream(testWorker(upstreams...), utils.UserParams{}, "example.com:443", true, 1000, tt.attempts, 0)
+			if err == nil || conn != nil || upstream != nil {
+				t.Fatalf("dialUpstream = %v, %v, %v, want an error", conn, upstream, err)
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("err = %v, want %q", err, tt.want)
+			}
+		})
+	}
+	if _, _, err := dialUpstream(testWorker(), utils.UserParams{}, "example.com:443", true, 1000, 3, 0); err == nil {
+		t.Error("dialUpstream without upstreams succeeded")
+	}
+}
+
+func TestDialUpstreamPinsSession(t *testing.T) {
+	a := newFakeUpstream(t, "200 OK")
+	b := newFakeUpstream(t, "200 OK")
+	worker := testWorker(a.Upstream, b.Upstream)
+	user := utils.ParseUserParams("alice-session-s1")
+
+	_, first, err := dialUpstream(worker, user, "example.com:443", true, 1000, 3, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		_, upstream, err := dialUpstream(worker, user, "example.com:443", true, 1000, 3, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if upstream.UpstreamID != first.UpstreamID {
+			t.Fatalf("dial %d of the session went to %s, want the pinned %s", i, upstream.GetAddress(), first.GetAddress())
+		}
+	}
+
+	// the pinned upstream is gone, the session moves to the other and stays there
+	other := a.Upstream
+	if first.UpstreamID == a.UpstreamID {
+		other = b.Upstream
+	}
+	worker.UpstreamManager.SetUpstreams([]manager.Upstream{other})
+	_, upstream, err := dialUpstream(worker, user, "example.com:443", true, 1000, 3, 0)
+	if err != nil || upstream.UpstreamID != other.UpstreamID {
+		t.Fatalf("dialUpstream = %v, %v, want the remaining upstream", upstream, err)
+	}
+	if id, ok := worker.Sessions.Get(manager.SessionKey("alice", "s1")); !ok || id != other.UpstreamID {
+		t.Errorf("session pinned to %s, want %s", id, other.UpstreamID)
+	}
+}
+
+func TestDialUpstreamTargetRefused(t *testing.T) {
+	tests := []struct {
+		status     string
+		httpStatus string
+		socksReply byte
+	}{
+		{"502 Bad Gateway", "502 Bad Gateway", 0x04},
+		{"403 Forbidden", "403 Forbidden", 0x02},
+		{"504 Gateway Timeout", "504 Gateway Timeout", 0x06},
+	}
+	for _, tt := range tests {
+		t.Run(tt.status, func(t *testing.T) {
+			refusing := newFakeUpstream(t, tt.status)
+			refusing.Weight = 10
+			other := newFakeUpstream(t, "200 OK")
+			worker := testWorker(refusing.Upstream, other.Upstream)
+
+			// the weights select the refusing upstream every time, as many times as it takes
+			// failures to open a breaker
+			for i := 0; i < 5; i++ {
+				conn, upstream, err := dialUpstream(worker, utils.UserParams{}, "unreachable.example:443", true, 1000, 3, 0)
+				refused, ok := utils.IsTargetRefused(err)
+				if !ok || conn != nil || upstream != nil {
+					t.Fatalf("dialUpstream = %v, %v, %v, want a TargetRefusedError", conn, upstream, err)
+				}
+				if refused.HTTPStatus() != tt.httpStatus || refused.SocksReply() != tt.socksReply {
+					t.Errorf("refusal maps to %q and reply %d, want %q and %d", refused.HTTPStatus(), refused.SocksReply(), tt.httpStatus, tt.socksReply)
+				}
+			}
+			if n := atomic.LoadInt32(&other.accepted); n != 0 {
+				t.Errorf("other upstream dialed %d times, refusals must not be retried", n)
+			}
+			if state := worker.UpstreamManager.BreakerState(refusing.UpstreamID); state != manager.BreakerClosed {
+				t.Errorf("breaker of the refusing upstream is %s, refusals are no upstream failures", state)
+			}
+		})
+	}
+}
+
+func TestDialUpstreamTargeting(t *testing.T) {
+	us := newFakeUpstream(t, "200 OK")
+	us.UpstreamCountry, us.UpstreamTag = "US", "dc"
+	de := newFakeUpstream(t, "200 OK")
+	de.UpstreamCountry, de.UpstreamTag = "DE", "resi"
+	unknown := newFakeUpstream(t, "200 OK")
+	unknown.UpstreamTag = "dc"
+	worker := testWorker(us.Upstream, de.Upstream, unknown.Upstream)
+
+	tests := []struct {
+		user string
+		want []uuid.UUID
+	}{
+		{"alice-country-de", []uuid.UUID{de.UpstreamID}},
+		{"alice-country-us", []uuid.UUID{us.UpstreamID}},
+		{"alice-tag-dc", []uuid.UUID{us.UpstreamID, unknown.UpstreamID}},
+		// no upstream is known to be in france, one without a country may be
+		{"alice-country-fr", []uuid.UUID{unknown.UpstreamID}},
+		{"alice-country-fr-tag-resi", nil},
+		{"alice-provider-acme", nil},
+	}
+	for _, tt := range tests {
+		for i := 0; i < 4; i++ {
+			conn, upstream, err := dialUpstream(worker, utils.ParseUserParams(tt.user), "example.com:443", true, 1000, 3, 0)
+			if tt.want == nil {
+				if err != manager.ErrNoMatchingUpstream {
+					t.Errorf("%s: err = %v, want ErrNoMatchingUpstream", tt.user, err)
+				}
+				break
+			}
+			if err != nil {
+				t.Fatalf("%s: %v", tt.user, err)
+			}
+			conn.Close()
+			found := false
+			for _, id := range tt.want {
+				found = found || upstream.UpstreamID == id
+			}
+			if !found {
+				t.Errorf("%s: connected through %s (country %q, tag %q)", tt.user, upstream.GetAddress(), upstream.UpstreamCountry, upstream.UpstreamTag)
+			}
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"sync"
+	"time"
+)
+
+// authCacheMaxFailures bounds the failed passwords remembered per user
+const authCacheMaxFailures = 16
+
+// AuthCache remembers the results of remote password checks so not every connection waits
+// for Captain. Successes are kept for TTL and failures for NegativeTTL, a zero TTL disables
+// caching of that kind. Passwords are only kept as hashes.
+// A nil *AuthCache is valid and caches nothing.
+type AuthCache struct {
+	TTL         time.Duration
+	NegativeTTL time.Duration
+
+	users map[string]*authCacheUser
+	mu    sync.Mutex
+}
+
+type authCacheUser struct {
+	// valid is the hash of the accepted password, zero when there is none
+	valid        [sha256.Size]byte
+	validExpires time.Time
+	// failures holds rejected password hashes, so a client retrying a wrong password
+	// does not evict the accepted one of the same user
+	failures map[[sha256.Size]byte]time.Time
+}
+
+// NewAuthCache creates an empty cache
+func NewAuthCache(ttl, negativeTTL time.Duration) *AuthCache {
+	return &AuthCache{
+		TTL:         ttl,
+		NegativeTTL: negativeTTL,
+		users:       make(map[string]*authCacheUser),
+	}
+}
+
+// Get returns the cached result for user and pass, found is false on a miss or expired entry
+func (c *AuthCache) Get(user, pass string) (ok, found bool) {
+	if c == nil {
+		return
+	}
+	hash := sha256.Sum256([]byte(pass))
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry := c.users[user]
+	if entry == nil {
+		return
+	}
+	if entry.valid == hash && now.Before(entry.validExpires) {
+		return true, true
+	}
+	if expires, exists := entry.failures[hash]; exists {
+		if now.Before(expires) {
+			return false, true
+		}
+		delete(entry.failures, hash)
+	}
+	return
+}
+
+// Set records the result of checking user and pass
+func (c *AuthCache) Set(user, pass string, ok bool) {
+	if c == nil {
+		return
+	}
+	ttl := c.TTL
+	if !ok {
+		ttl = c.NegativeTTL
+	}
+	if ttl <= 0 {
+		return
+	}
+	hash := sha256.Sum256([]byte(pass))
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry := c.users[user]
+	if entry == nil {
+		entry = &authCacheUser{failures: make(map[[sha256.Size]byte]time.Time)}
+		c.users[user] = entry
+	}
+	if ok {
+		entry.valid = hash
+		entry.validExpires = now.Add(ttl)
+		delete(entry.failures, hash)
+		return
+	}
+	if entry.valid == hash {
+		entry.validExpires = time.Time{}
+	}
+	if len(entry.failures) >= authCacheMaxFailures {
+		for h, expires := range entry.failures {
+			if !now.Before(expires) || len(entry.failures) >= authCacheMaxFailures {
+				delete(entry.failures, h)
+			}
+		}
+	}
+	entry.failures[hash] = now.Add(ttl)
+}
+
+// Delete evicts every cached result of user
+func (c *AuthCache) Delete(user string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	delete(c.users, user)
+	c.mu.Unlock()
+}
+
+// Purge drops expired entries
+func (c *AuthCache) Purge() {
+	if c == nil {
+		return
+	}
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for user, entry := range c.users {
+		for h, expires := range entry.failures {
+			if !now.Before(expires) {
+				delete(entry.failures, h)
+			}
+		}
+		if !now.Before(entry.validExpires) && len(entry.failures) == 0 {
+			delete(c.users, user)
+		}
+	}
+}
+
+// Count returns the number of users with cached results
+func (c *AuthCache) Count() int {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.users)
+}
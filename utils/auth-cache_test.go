@@ -0,0 +1,96 @@
+package utils
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestAuthCacheTTL(t *testing.T) {
+	c := NewAuthCache(50*time.Millisecond, 20*time.Millisecond)
+	c.Set("alice", "right", true)
+	c.Set("alice", "wrong", false)
+	if ok, found := c.Get("alice", "right"); !ok || !found {
+		t.Fatalf("Get(right) = %v, %v, want a cached success", ok, found)
+	}
+	if ok, found := c.Get("alice", "wrong"); ok || !found {
+		t.Fatalf("Get(wrong) = %v, %v, want a cached failure", ok, found)
+	}
+	if _, found := c.Get("alice", "other"); found {
+		t.Fatal("Get of an unchecked password hit the cache")
+	}
+	if _, found := c.Get("bob", "right"); found {
+		t.Fatal("Get of another user hit the cache")
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if _, found := c.Get("alice", "wrong"); found {
+		t.Error("failure still cached after NegativeTTL")
+	}
+	if ok, found := c.Get("alice", "right"); !ok || !found {
+		t.Error("success expired before TTL")
+	}
+	time.Sleep(30 * time.Millisecond)
+	if _, found := c.Get("alice", "right"); found {
+		t.Error("success still cached after TTL")
+	}
+	c.Purge()
+	if n := c.Count(); n != 0 {
+		t.Errorf("Count after Purge = %d, want 0", n)
+	}
+}
+
+func TestAuthCacheWrongPasswordKeepsSuccess(t *testing.T) {
+	c := NewAuthCache(time.Minute, time.Minute)
+	c.Set("alice", "right", true)
+	for i := 0; i < 2*authCacheMaxFailures; i++ {
+		c.Set("alice", string(rune('a'+i)), false)
+	}
+	if ok, found := c.Get("alice", "right"); !ok || !found {
+		t.Error("failed passwords evicted the accepted one")
+	}
+	c.Set("alice", "right", false)
+	if ok, found := c.Get("alice", "right"); ok || !found {
+		t.Errorf("Get after the password was rejected = %v, %v, want a cached failure", ok, found)
+	}
+	c.Delete("alice")
+	if _, found := c.Get("alice", "right"); found {
+		t.Error("Delete kept cached results")
+	}
+}
+
+func TestAuthCacheZeroTTLDisables(t *testing.T) {
+	c := NewAuthCache(time.Minute, 0)
+	c.Set("alice", "wrong", false)
+	if _, found := c.Get("alice", "wrong"); found {
+		t.Error("failure cached with a zero NegativeTTL")
+	}
+	var nilCache *AuthCache
+	nilCache.Set("alice", "right", true)
+	if _, found := nilCache.Get("alice", "right"); found {
+		t.Error("nil cache returned a result")
+	}
+}
+
+func TestBasicAuthDoesNotCacheUndecidedChecks(t *testing.T) {
+	calls := 0
+	var verr error
+	ba := NewBasicAuth()
+	ba.Cache = NewAuthCache(time.Minute, time.Minute)
+	ba.Validator = func(user, pass string) (bool, error) {
+		calls++
+		return false, verr
+	}
+
+	verr = errors.New("timeout")
+	ba.Check("alice:pass")
+	verr = nil
+	ba.Check("alice:pass")
+	if calls != 2 {
+		t.Fatalf("Validator called %d times, want 2, an undecided check must not be cached", calls)
+	}
+	ba.Check("alice:pass")
+	if calls != 2 {
+		t.Errorf("Validator called %d times, want 2, a rejection must be cached", calls)
+	}
+}
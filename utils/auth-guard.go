@@ -0,0 +1,156 @@
+package utils
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// Kinds of AuthGuard bans
+const (
+	BanKindIP       = "ip"
+	BanKindUsername = "username"
+)
+
+// AuthBan describes a ban the AuthGuard just applied
+type AuthBan struct {
+	Kind string
+	// Key is the banned source ip or username
+	Key      string
+	SourceIP string
+	Username string
+	Failures int
+	Duration time.Duration
+}
+
+// AuthGuard counts failed logins per source ip and per username in a sliding window and
+// bans a source or username that fails too often, so credential stuffing neither reaches
+// Captain nor gets to probe freely. A zero limit disables that kind of ban.
+// A nil *AuthGuard is valid and bans nothing.
+type AuthGuard struct {
+	Window          time.Duration
+	MaxIPFailures   int
+	MaxUserFailures int
+	BanDuration     time.Duration
+	// OnBan, when set, is called outside the lock for every new ban
+	OnBan func(ban AuthBan)
+
+	ipFailures   map[string][]time.Time
+	userFailures map[string][]time.Time
+	ipBans       map[string]time.Time
+	userBans     map[string]time.Time
+	mu           sync.Mutex
+}
+
+// NewAuthGuard creates a guard without failures or bans
+func NewAuthGuard(window time.Duration, maxIPFailures, maxUserFailures int, banDuration time.Duration) *AuthGuard {
+	return &AuthGuard{
+		Window:          window,
+		MaxIPFailures:   maxIPFailures,
+		MaxUserFailures: maxUserFailures,
+		BanDuration:     banDuration,
+		ipFailures:      make(map[string][]time.Time),
+		userFailures:    make(map[string][]time.Time),
+		ipBans:          make(map[string]time.Time),
+		userBans:        make(map[string]time.Time),
+	}
+}
+
+// Banned reports whether connections from ip are banned
+func (g *AuthGuard) Banned(ip string) bool {
+	if g == nil {
+		return false
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return banActive(g.ipBans, ip, time.Now())
+}
+
+// UserBanned reports whether logins as username are banned
+func (g *AuthGuard) UserBanned(username string) bool {
+	if g == nil {
+		return false
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return banActive(g.userBans, username, time.Now())
+}
+
+// RecordFailure counts a failed login of username from ip and bans either once it
+// reaches its limit within the window
+func (g *AuthGuard) RecordFailure(ip, username string) {
+	if g == nil || g.BanDuration <= 0 || g.Window <= 0 {
+		return
+	}
+	now := time.Now()
+	var bans []AuthBan
+	g.mu.Lock()
+	if ip != "" && g.MaxIPFailures > 0 && !banActive(g.ipBans, ip, now) {
+		if n := g.push(g.ipFailures, ip, now, g.MaxIPFailures); n >= g.MaxIPFailures {
+			g.ipBans[ip] = now.Add(g.BanDuration)
+			delete(g.ipFailures, ip)
+			bans = append(bans, AuthBan{Kind: BanKindIP, Key: ip, SourceIP: ip, Username: username, Failures: n, Duration: g.BanDuration})
+		}
+	}
+	if username != "" && g.MaxUserFailures > 0 && !banActive(g.userBans, username, now) {
+		if n := g.push(g.userFailures, username, now, g.MaxUserFailures); n >= g.MaxUserFailures {
+			g.userBans[username] = now.Add(g.BanDuration)
+			delete(g.userFailures, username)
+			bans = append(bans, AuthBan{Kind: BanKindUsername, Key: username, SourceIP: ip, Username: username, Failures: n, Duration: g.BanDuration})
+		}
+	}
+	g.mu.Unlock()
+
+	for _, ban := range bans {
+		log.Printf("auth guard banned %s %s for %s after %d failed logins", ban.Kind, ban.Key, ban.Duration, ban.Failures)
+		if g.OnBan != nil {
+			g.OnBan(ban)
+		}
+	}
+}
+
+// push adds a failure to the window of key and returns the failures within the window
+func (g *AuthGuard) push(failures map[string][]time.Time, key string, now time.Time, max int) int {
+	times := failures[key]
+	cutoff := now.Add(-g.Window)
+	i := 0
+	for i < len(times) && !times[i].After(cutoff) {
+		i++
+	}
+	times = append(times[i:], now)
+	if len(times) > max {
+		times = times[len(times)-max:]
+	}
+	failures[key] = times
+	return len(times)
+}
+
+// Purge drops expired bans and failures that left the window
+func (g *AuthGuard) Purge() {
+	if g == nil {
+		return
+	}
+	now := time.Now()
+	cutoff := now.Add(-g.Window)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, bans := range []map[string]time.Time{g.ipBans, g.userBans} {
+		for key, until := range bans {
+			if !now.Before(until) {
+				delete(bans, key)
+			}
+		}
+	}
+	for _, failures := range []map[string][]time.Time{g.ipFailures, g.userFailures} {
+		for key, times := range failures {
+			if len(times) == 0 || !times[len(times)-1].After(cutoff) {
+				delete(failures, key)
+			}
+		}
+	}
+}
+
+func banActive(bans map[string]time.Time, key string, now time.Time) bool {
+	until, ok := bans[key]
+	return ok && now.Before(until)
+}
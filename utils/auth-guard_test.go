@@ -0,0 +1,109 @@
+package utils
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestAuthGuardBansIP(t *testing.T) {
+	var bans []AuthBan
+	g := NewAuthGuard(time.Minute, 3, 0, 50*time.Millisecond)
+	g.OnBan = func(ban AuthBan) { bans = append(bans, ban) }
+
+	for i := 0; i < 2; i++ {
+		g.RecordFailure("1.2.3.4", "alice")
+	}
+	if g.Banned("1.2.3.4") {
+		t.Fatal("banned before reaching the limit")
+	}
+	g.RecordFailure("1.2.3.4", "alice")
+	if !g.Banned("1.2.3.4") {
+		t.Fatal("not banned after reaching the limit")
+	}
+	if g.Banned("5.6.7.8") || g.UserBanned("alice") {
+		t.Fatal("ban applied to another source or to the username")
+	}
+	if len(bans) != 1 || bans[0].Kind != BanKindIP || bans[0].Key != "1.2.3.4" || bans[0].Failures != 3 {
+		t.Fatalf("OnBan got %+v, want one ip ban of 1.2.3.4 after 3 failures", bans)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if g.Banned("1.2.3.4") {
+		t.Error("still banned after BanDuration")
+	}
+	g.Purge()
+	if len(g.ipBans) != 0 {
+		t.Error("Purge kept an expired ban")
+	}
+}
+
+func TestAuthGuardWindow(t *testing.T) {
+	g := NewAuthGuard(30*time.Millisecond, 2, 0, time.Minute)
+	g.RecordFailure("1.2.3.4", "")
+	time.Sleep(40 * time.Millisecond)
+	g.RecordFailure("1.2.3.4", "")
+	if g.Banned("1.2.3.4") {
+		t.Fatal("a failure that left the window counted towards the ban")
+	}
+	g.RecordFailure("1.2.3.4", "")
+	if !g.Banned("1.2.3.4") {
+		t.Fatal("not banned after two failures within the window")
+	}
+	time.Sleep(40 * time.Millisecond)
+	g.Purge()
+	if len(g.ipFailures) != 0 {
+		t.Error("Purge kept failures that left the window")
+	}
+}
+
+func TestAuthGuardUserBans(t *testing.T) {
+	off := NewAuthGuard(time.Minute, 0, 0, time.Minute)
+	for i := 0; i < 100; i++ {
+		off.RecordFailure("1.2.3.4", "alice")
+	}
+	if off.Banned("1.2.3.4") || off.UserBanned("alice") {
+		t.Fatal("zero limits banned")
+	}
+
+	g := NewAuthGuard(time.Minute, 0, 2, time.Minute)
+	g.RecordFailure("1.2.3.4", "alice")
+	g.RecordFailure("5.6.7.8", "alice")
+	if !g.UserBanned("alice") {
+		t.Fatal("username not banned after failures from several sources")
+	}
+	if g.UserBanned("bob") || g.Banned("1.2.3.4") {
+		t.Fatal("ban applied to another username or to the sources")
+	}
+}
+
+func TestBasicAuthCountsOnlyRejectedCredentials(t *testing.T) {
+	var verr error
+	ba := NewBasicAuth()
+	ba.Add([]string{"alice:right"})
+	ba.Guard = NewAuthGuard(time.Minute, 2, 0, time.Minute)
+	ba.Validator = func(user, pass string) (bool, error) {
+		return false, verr
+	}
+
+	verr = errors.New("timeout")
+	for i := 0; i < 5; i++ {
+		ba.CheckFrom("bob:pass", "1.2.3.4")
+	}
+	if ba.Guard.Banned("1.2.3.4") {
+		t.Fatal("checks the Validator could not decide counted as failed logins")
+	}
+
+	verr = nil
+	if !ba.CheckFrom("alice:right", "1.2.3.4") {
+		t.Fatal("valid credentials rejected")
+	}
+	ba.CheckFrom("alice:wrong", "1.2.3.4")
+	ba.CheckFrom("bob:pass", "1.2.3.4")
+	if !ba.Guard.Banned("1.2.3.4") {
+		t.Fatal("not banned after two rejected logins")
+	}
+	if ba.CheckFrom("alice:right", "1.2.3.4") {
+		t.Error("banned source passed the check")
+	}
+}
@@ -0,0 +1,61 @@
+package utils
+
+import (
+	"os"
+	"time"
+)
+
+// FileWatchInterval is how often watched files are checked for changes
+const FileWatchInterval = 5 * time.Second
+
+// FileWatcher polls the modification time and size of a file and calls onChange when they
+// change, including when the file is created or removed
+type FileWatcher struct {
+	path     string
+	onChange func()
+	stopCh   chan struct{}
+}
+
+// WatchFile starts watching path every interval, the current state is the baseline so
+// onChange is not called for it
+func WatchFile(path string, interval time.Duration, onChange func()) *FileWatcher {
+	w := &FileWatcher{
+		path:     path,
+		onChange: onChange,
+		stopCh:   make(chan struct{}),
+	}
+	go w.run(interval)
+	return w
+}
+
+// Stop stops watching
+func (w *FileWatcher) Stop() {
+	close(w.stopCh)
+}
+
+func (w *FileWatcher) run(interval time.Duration) {
+	modTime, size, exists := w.stat()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			m, s, e := w.stat()
+			if m.Equal(modTime) && s == size && e == exists {
+				continue
+			}
+			modTime, size, exists = m, s, e
+			w.onChange()
+		case <-w.stopCh:
+			return
+		}
+	}
+}
+
+func (w *FileWatcher) stat() (modTime time.Time, size int64, exists bool) {
+	info, err := os.Stat(w.path)
+	if err != nil {
+		return
+	}
+	return info.ModTime(), info.Size(), true
+}
@@ -0,0 +1,87 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileWatcher(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "auth")
+	changes := make(chan struct{}, 10)
+	w := WatchFile(path, 10*time.Millisecond, func() { changes <- struct{}{} })
+	defer w.Stop()
+	time.Sleep(30 * time.Millisecond)
+
+	expect := func(what string) {
+		t.Helper()
+		select {
+		case <-changes:
+		case <-time.After(time.Second):
+			t.Fatalf("no change reported after %s", what)
+		}
+	}
+	if err := os.WriteFile(path, []byte("alice:pass\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	expect("creating the file")
+	if err := os.WriteFile(path, []byte("alice:pass\nbob:pass\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	expect("growing the file")
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	expect("removing the file")
+
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case <-changes:
+		t.Error("change reported for an unchanged file")
+	default:
+	}
+}
+
+func TestBasicAuthReloadFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "auth")
+	if err := os.WriteFile(path, []byte("alice:a\nbob:b\n# comment\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	ba := NewBasicAuth()
+	ba.Add([]string{"static:s"})
+	if n, err := ba.AddFromFile(path); err != nil || n != 2 {
+		t.Fatalf("AddFromFile = %d, %v, want 2 users", n, err)
+	}
+
+	if err := os.WriteFile(path, []byte("alice:changed\ncarol:c\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	added, removed, changed, err := ba.ReloadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added != 1 || removed != 1 || changed != 1 {
+		t.Errorf("ReloadFile = %d added, %d removed, %d changed, want 1 each", added, removed, changed)
+	}
+	for userpass, want := range map[string]bool{
+		"alice:changed": true,
+		"alice:a":       false,
+		"bob:b":         false,
+		"carol:c":       true,
+		"static:s":      true,
+	} {
+		if got := ba.Check(userpass); got != want {
+			t.Errorf("Check(%q) = %v after reload, want %v", userpass, got, want)
+		}
+	}
+
+	// a missing file keeps the current users
+	os.Remove(path)
+	if _, _, _, err := ba.ReloadFile(path); err == nil {
+		t.Error("ReloadFile of a missing file succeeded")
+	}
+	if !ba.Check("carol:c") {
+		t.Error("a failed reload dropped the users")
+	}
+}
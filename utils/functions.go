@@ -20,9 +20,25 @@ import (
 	"strconv"
 	"strings"
 	"time"
+
+	"golang.org/x/time/rate"
 )
 
 func IoBind(dst io.ReadWriter, src io.ReadWriter, fn func(isSrcErr bool, err error), cfn func(count int, isPositive bool), bytesPreSec float64) {
+	var srcLimiter, dstLimiter *rate.Limiter
+	if bytesPreSec > 0 {
+		srcReader := NewReader(src)
+		srcReader.SetRateLimit(bytesPreSec)
+		dstReader := NewReader(dst)
+		dstReader.SetRateLimit(bytesPreSec)
+		srcLimiter, dstLimiter = srcReader.limiter, dstReader.limiter
+	}
+	IoBindLimited(dst, src, fn, cfn, srcLimiter, dstLimiter)
+}
+
+// IoBindLimited is IoBind with the reads from src and from dst waiting on the given limiters,
+// which may be shared with other connections. A nil limiter means no limit.
+func IoBindLimited(dst io.ReadWriter, src io.ReadWriter, fn func(isSrcErr bool, err error), cfn func(count int, isPositive bool), srcLimiter, dstLimiter *rate.Limiter) {
 	var one = &sync.Once{}
 	go func() {
 		defer func() {
@@ -32,9 +48,9 @@ func IoBind(dst io.ReadWriter, src io.ReadWriter, fn func(isSrcErr bool, err err
 		}()
 		var err error
 		var isSrcErr bool
-		if bytesPreSec > 0 {
+		if srcLimiter != nil {
 			newreader := NewReader(src)
-			newreader.SetRateLimit(bytesPreSec)
+			newreader.SetLimiter(srcLimiter)
 			_, isSrcErr, err = ioCopy(dst, newreader, func(c int) {
 				cfn(c, false)
 			})
@@ -58,9 +74,9 @@ func IoBind(dst io.ReadWriter, src io.ReadWriter, fn func(isSrcErr bool, err err
 		}()
 		var err error
 		var isSrcErr bool
-		if bytesPreSec > 0 {
+		if dstLimiter != nil {
 			newReader := NewReader(dst)
-			newReader.SetRateLimit(bytesPreSec)
+			newReader.SetLimiter(dstLimiter)
 			_, isSrcErr, err = ioCopy(src, newReader, func(c int) {
 				cfn(c, true)
 			})
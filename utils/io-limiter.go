@@ -10,6 +10,10 @@ import (
 
 const burstLimit = 1000 * 1000 * 1000
 
+// MinSharedBurst is the smallest burst of a limiter shared by several connections, it must
+// fit the largest single read of a copy loop
+const MinSharedBurst = 32 * 1024
+
 type Reader struct {
 	r       io.Reader
 	limiter *rate.Limiter
@@ -60,6 +64,34 @@ func (s *Reader) SetRateLimit(bytesPerSec float64) {
 	s.limiter.AllowN(time.Now(), burstLimit) // spend initial burst
 }
 
+// SetLimiter makes the reader wait on limiter, which may be shared with other readers
+// so they split its rate. A nil limiter turns rate limiting off.
+func (s *Reader) SetLimiter(limiter *rate.Limiter) {
+	s.limiter = limiter
+}
+
+// NewSharedLimiter returns a limiter for bytesPerSec to share between connections,
+// zero or less means unlimited
+func NewSharedLimiter(bytesPerSec float64) *rate.Limiter {
+	limiter := rate.NewLimiter(rate.Inf, MinSharedBurst)
+	SetSharedLimit(limiter, bytesPerSec)
+	return limiter
+}
+
+// SetSharedLimit changes the rate of a shared limiter, connections using it follow at once
+func SetSharedLimit(limiter *rate.Limiter, bytesPerSec float64) {
+	if bytesPerSec <= 0 {
+		limiter.SetLimit(rate.Inf)
+		return
+	}
+	burst := int(bytesPerSec)
+	if burst < MinSharedBurst {
+		burst = MinSharedBurst
+	}
+	limiter.SetBurst(burst)
+	limiter.SetLimit(rate.Limit(bytesPerSec))
+}
+
 // Read reads bytes into p.
 func (s *Reader) Read(p []byte) (int, error) {
 	if s.limiter == nil {
@@ -0,0 +1,53 @@
+package utils
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+func TestSharedLimiterSplitsRate(t *testing.T) {
+	const bytesPerSec = 64 * 1024
+	limiter := NewSharedLimiter(bytesPerSec)
+	// spend the initial burst so only the rate counts
+	limiter.AllowN(time.Now(), limiter.Burst())
+
+	start := time.Now()
+	done := make(chan struct{})
+	for i := 0; i < 2; i++ {
+		go func() {
+			r := NewReader(bytes.NewReader(make([]byte, bytesPerSec/4)))
+			r.SetLimiter(limiter)
+			io.Copy(io.Discard, r)
+			done <- struct{}{}
+		}()
+	}
+	<-done
+	<-done
+	// two readers of a quarter second each share one rate, half a second together
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("shared limiter let %d bytes through in %s", bytesPerSec/2, elapsed)
+	}
+}
+
+func TestSetSharedLimit(t *testing.T) {
+	limiter := NewSharedLimiter(0)
+	if limiter.Limit() != rate.Inf {
+		t.Fatalf("limit = %v, want unlimited", limiter.Limit())
+	}
+	SetSharedLimit(limiter, 1024)
+	if limiter.Limit() != 1024 || limiter.Burst() != MinSharedBurst {
+		t.Errorf("limit %v burst %d, want 1024 and the minimum burst", limiter.Limit(), limiter.Burst())
+	}
+	SetSharedLimit(limiter, 10*MinSharedBurst)
+	if limiter.Burst() != 10*MinSharedBurst {
+		t.Errorf("burst %d, want one second of the rate", limiter.Burst())
+	}
+	SetSharedLimit(limiter, -1)
+	if limiter.Limit() != rate.Inf {
+		t.Errorf("limit = %v after removing the limit, want unlimited", limiter.Limit())
+	}
+}
@@ -0,0 +1,114 @@
+package utils
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// IPAuthEntry authenticates every connection from Network as Username
+type IPAuthEntry struct {
+	Network  *net.IPNet
+	Username string
+}
+
+// IPAuthList maps source addresses to the users they authenticate as, for clients that cannot
+// send credentials. The most specific matching network wins. It is safe for concurrent use,
+// Set swaps the entries as a whole.
+type IPAuthList struct {
+	entries atomic.Value // []IPAuthEntry sorted by prefix length, longest first
+}
+
+// NewIPAuthList creates an empty list
+func NewIPAuthList() *IPAuthList {
+	l := &IPAuthList{}
+	l.entries.Store([]IPAuthEntry{})
+	return l
+}
+
+// ParseIPAuthNetwork parses a single IP or a CIDR
+func ParseIPAuthNetwork(s string) (*net.IPNet, error) {
+	s = strings.TrimSpace(s)
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid ip %q", s)
+		}
+		bits := 32
+		if ip.To4() == nil {
+			bits = 128
+		} else {
+			ip = ip.To4()
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, network, err := net.ParseCIDR(s)
+	return network, err
+}
+
+// Set replaces the entries
+func (l *IPAuthList) Set(entries []IPAuthEntry) {
+	sorted := make([]IPAuthEntry, len(entries))
+	copy(sorted, entries)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		oi, _ := sorted[i].Network.Mask.Size()
+		oj, _ := sorted[j].Network.Mask.Size()
+		return oi > oj
+	})
+	l.entries.Store(sorted)
+}
+
+// Len returns the number of entries
+func (l *IPAuthList) Len() int {
+	if l == nil {
+		return 0
+	}
+	return len(l.entries.Load().([]IPAuthEntry))
+}
+
+// Lookup returns the user a source ip authenticates as
+func (l *IPAuthList) Lookup(ip string) (username string, ok bool) {
+	if l == nil {
+		return
+	}
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return
+	}
+	for _, entry := range l.entries.Load().([]IPAuthEntry) {
+		if entry.Network.Contains(parsed) {
+			return entry.Username, true
+		}
+	}
+	return
+}
+
+// LoadFile replaces the entries with the "cidr username" lines of file, lines starting
+// with # are comments. The old entries are kept when the file has an invalid line.
+func (l *IPAuthList) LoadFile(file string) (n int, err error) {
+	_content, err := os.ReadFile(file)
+	if err != nil {
+		return
+	}
+	var entries []IPAuthEntry
+	for i, line := range strings.Split(strings.Replace(string(_content), "\r", "", -1), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return 0, fmt.Errorf("line %d: want \"cidr username\", got %q", i+1, line)
+		}
+		network, e := ParseIPAuthNetwork(fields[0])
+		if e != nil {
+			return 0, fmt.Errorf("line %d: %s", i+1, e)
+		}
+		entries = append(entries, IPAuthEntry{Network: network, Username: fields[1]})
+	}
+	l.Set(entries)
+	return len(entries), nil
+}
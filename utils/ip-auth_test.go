@@ -0,0 +1,70 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIPAuthListLookup(t *testing.T) {
+	l := NewIPAuthList()
+	var entries []IPAuthEntry
+	for network, user := range map[string]string{
+		"10.0.0.0/8":  "wide",
+		"10.1.0.0/16": "narrow",
+		"10.1.2.3":    "single",
+		"2001:db8::1": "v6",
+	} {
+		n, err := ParseIPAuthNetwork(network)
+		if err != nil {
+			t.Fatalf("ParseIPAuthNetwork(%q): %v", network, err)
+		}
+		entries = append(entries, IPAuthEntry{Network: n, Username: user})
+	}
+	l.Set(entries)
+
+	tests := []struct {
+		ip   string
+		want string
+	}{
+		{"10.9.9.9", "wide"},
+		{"10.1.9.9", "narrow"},
+		{"10.1.2.3", "single"},
+		{"2001:db8::1", "v6"},
+		{"2001:db8::2", ""},
+		{"192.168.1.1", ""},
+		{"not an ip", ""},
+	}
+	for _, tt := range tests {
+		user, ok := l.Lookup(tt.ip)
+		if user != tt.want || ok != (tt.want != "") {
+			t.Errorf("Lookup(%q) = %q, %v, want %q", tt.ip, user, ok, tt.want)
+		}
+	}
+	var nilList *IPAuthList
+	if _, ok := nilList.Lookup("10.1.2.3"); ok || nilList.Len() != 0 {
+		t.Error("nil list authenticated a source")
+	}
+}
+
+func TestIPAuthListLoadFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ip-auth")
+	os.WriteFile(path, []byte("# office\n192.0.2.0/24 alice\r\n\n198.51.100.7 bob\n"), 0600)
+	l := NewIPAuthList()
+	if n, err := l.LoadFile(path); err != nil || n != 2 {
+		t.Fatalf("LoadFile = %d, %v, want 2 entries", n, err)
+	}
+	if user, _ := l.Lookup("192.0.2.99"); user != "alice" {
+		t.Errorf("Lookup = %q, want alice", user)
+	}
+
+	for _, bad := range []string{"192.0.2.0/24\n", "192.0.2.0/33 alice\n", "nonsense bob\n", "1.2.3.4 bob extra\n"} {
+		os.WriteFile(path, []byte(bad), 0600)
+		if _, err := l.LoadFile(path); err == nil {
+			t.Errorf("LoadFile accepted %q", bad)
+		}
+	}
+	if user, _ := l.Lookup("198.51.100.7"); user != "bob" {
+		t.Error("an invalid file replaced the entries")
+	}
+}
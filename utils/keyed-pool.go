@@ -0,0 +1,208 @@
+package utils
+
+import (
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrSkipFill is returned by a pool factory that does not want connections dialed right now,
+// the pool is topped up again on its next round
+var ErrSkipFill = errors.New("pool fill skipped")
+
+// KeyedPool keeps a few pre-dialed connections for each key, e.g. one pool per upstream.
+// Pools are filled in the background and Get never dials, so a miss costs nothing on the
+// request path and the caller simply dials itself.
+type KeyedPool struct {
+	size    int
+	maxIdle time.Duration
+	pools   map[string]*warmPool
+	mu      sync.Mutex
+}
+
+type warmPool struct {
+	key     string
+	factory func() (net.Conn, error)
+	conns   chan idleConn
+	stopCh  chan struct{}
+}
+
+type idleConn struct {
+	conn  net.Conn
+	since time.Time
+}
+
+// NewKeyedPool creates a keyed pool holding up to size connections per key,
+// idle connections older than maxIdle are closed instead of handed out
+func NewKeyedPool(size int, maxIdle time.Duration) *KeyedPool {
+	return &KeyedPool{
+		size:    size,
+		maxIdle: maxIdle,
+		pools:   make(map[string]*warmPool),
+	}
+}
+
+// Set creates the pool for key, replacing and draining an existing one
+func (kp *KeyedPool) Set(key string, factory func() (net.Conn, error)) {
+	p := &warmPool{
+		key:     key,
+		factory: factory,
+		conns:   make(chan idleConn, kp.size),
+		stopCh:  make(chan struct{}),
+	}
+	kp.mu.Lock()
+	old := kp.pools[key]
+	kp.pools[key] = p
+	kp.mu.Unlock()
+	if old != nil {
+		old.drain()
+	}
+	go kp.fill(p)
+}
+
+// Remove drains and deletes the pool for key
+func (kp *KeyedPool) Remove(key string) {
+	kp.mu.Lock()
+	p := kp.pools[key]
+	delete(kp.pools, key)
+	kp.mu.Unlock()
+	if p != nil {
+		p.drain()
+	}
+}
+
+// Keys returns the keys that currently have a pool
+func (kp *KeyedPool) Keys() (keys []string) {
+	kp.mu.Lock()
+	defer kp.mu.Unlock()
+	for key := range kp.pools {
+		keys = append(keys, key)
+	}
+	return
+}
+
+// Get returns an idle connection for key, ok is false when none is ready
+func (kp *KeyedPool) Get(key string) (conn net.Conn, ok bool) {
+	kp.mu.Lock()
+	p := kp.pools[key]
+	kp.mu.Unlock()
+	if p == nil {
+		return nil, false
+	}
+	for {
+		select {
+		case c := <-p.conns:
+			if kp.usable(c) {
+				return c.conn, true
+			}
+			CloseConn(&c.conn)
+		default:
+			return nil, false
+		}
+	}
+}
+
+// ReleaseAll drains and deletes every pool
+func (kp *KeyedPool) ReleaseAll() {
+	kp.mu.Lock()
+	pools := kp.pools
+	kp.pools = make(map[string]*warmPool)
+	kp.mu.Unlock()
+	for _, p := range pools {
+		p.drain()
+	}
+}
+
+// usable reports whether an idle connection is young enough and was not closed by the peer
+func (kp *KeyedPool) usable(c idleConn) bool {
+	if kp.maxIdle > 0 && time.Since(c.since) > kp.maxIdle {
+		return false
+	}
+	c.conn.SetReadDeadline(time.Now().Add(time.Millisecond))
+	one := make([]byte, 1)
+	_, err := c.conn.Read(one)
+	c.conn.SetReadDeadline(time.Time{})
+	// a proxy sends nothing before the handshake, so only a timeout means the conn is alive
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return true
+	}
+	return false
+}
+
+// fill keeps the pool topped up until it is drained
+func (kp *KeyedPool) fill(p *warmPool) {
+	for {
+		// drop connections that went stale while idle
+		for i := len(p.conns); i > 0; i-- {
+			select {
+			case c := <-p.conns:
+				if kp.maxIdle > 0 && time.Since(c.since) > kp.maxIdle {
+					CloseConn(&c.conn)
+				} else {
+					select {
+					case p.conns <- c:
+					default:
+						CloseConn(&c.conn)
+					}
+				}
+			default:
+			}
+		}
+		errN := 0
+		for len(p.conns) < kp.size {
+			select {
+			case <-p.stopCh:
+				return
+			default:
+			}
+			conn, err := p.factory()
+			if err == ErrSkipFill {
+				break
+			}
+			if err != nil {
+				errN++
+				break
+			}
+			select {
+			case p.conns <- idleConn{conn: conn, since: time.Now()}:
+			default:
+				CloseConn(&conn)
+			}
+			// the pool may have been drained while dialing
+			select {
+			case <-p.stopCh:
+				p.closeIdle()
+				return
+			default:
+			}
+		}
+		if errN > 0 {
+			log.Printf("fill conn pool %s fail , ERRN:%d", p.key, errN)
+		}
+		select {
+		case <-p.stopCh:
+			p.closeIdle()
+			return
+		case <-time.After(time.Second * 2):
+		}
+	}
+}
+
+// drain stops filling the pool and closes its idle connections
+func (p *warmPool) drain() {
+	close(p.stopCh)
+	p.closeIdle()
+}
+
+func (p *warmPool) closeIdle() {
+	for {
+		select {
+		case c := <-p.conns:
+			CloseConn(&c.conn)
+		default:
+			return
+		}
+	}
+}
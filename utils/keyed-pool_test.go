@@ -0,0 +1,138 @@
+package utils
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// pipeFactory dials in-memory connections and counts them
+func pipeFactory(dials *int32) func() (net.Conn, error) {
+	return func() (net.Conn, error) {
+		atomic.AddInt32(dials, 1)
+		client, server := net.Pipe()
+		go func() {
+			// hold the server side open until the client closes
+			one := make([]byte, 1)
+			server.Read(one)
+			server.Close()
+		}()
+		return client, nil
+	}
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestKeyedPoolFillsEachKey(t *testing.T) {
+	kp := NewKeyedPool(2, time.Minute)
+	defer kp.ReleaseAll()
+	var dialsA, dialsB int32
+	kp.Set("a", pipeFactory(&dialsA))
+	kp.Set("b", pipeFactory(&dialsB))
+	waitFor(t, "both pools to fill", func() bool {
+		return atomic.LoadInt32(&dialsA) == 2 && atomic.LoadInt32(&dialsB) == 2
+	})
+
+	for i := 0; i < 2; i++ {
+		conn, ok := kp.Get("a")
+		if !ok {
+			t.Fatalf("Get %d of a missed a filled pool", i)
+		}
+		conn.Close()
+	}
+	if _, ok := kp.Get("a"); ok {
+		t.Error("Get returned more connections than the pool holds")
+	}
+	if _, ok := kp.Get("missing"); ok {
+		t.Error("Get returned a connection for a key without a pool")
+	}
+	if len(kp.Keys()) != 2 {
+		t.Errorf("Keys = %v, want a and b", kp.Keys())
+	}
+}
+
+func TestKeyedPoolDropsStaleConnections(t *testing.T) {
+	kp := NewKeyedPool(1, time.Minute)
+	defer kp.ReleaseAll()
+	closed := make(chan net.Conn, 1)
+	kp.Set("a", func() (net.Conn, error) {
+		client, server := net.Pipe()
+		closed <- server
+		return client, nil
+	})
+	server := <-closed
+	waitFor(t, "the pool to fill", func() bool {
+		kp.mu.Lock()
+		defer kp.mu.Unlock()
+		return len(kp.pools["a"].conns) == 1
+	})
+	// the peer closed the idle connection
+	server.Close()
+	if _, ok := kp.Get("a"); ok {
+		t.Error("Get returned a connection closed by the peer")
+	}
+
+	aged := NewKeyedPool(1, time.Millisecond)
+	defer aged.ReleaseAll()
+	var dials int32
+	aged.Set("a", pipeFactory(&dials))
+	waitFor(t, "the pool to fill", func() bool { return atomic.LoadInt32(&dials) == 1 })
+	time.Sleep(5 * time.Millisecond)
+	if _, ok := aged.Get("a"); ok {
+		t.Error("Get returned a connection idle for longer than maxIdle")
+	}
+}
+
+func TestKeyedPoolSkipAndErrors(t *testing.T) {
+	kp := NewKeyedPool(3, time.Minute)
+	defer kp.ReleaseAll()
+	var calls int32
+	kp.Set("skip", func() (net.Conn, error) {
+		atomic.AddInt32(&calls, 1)
+		return nil, ErrSkipFill
+	})
+	kp.Set("fail", func() (net.Conn, error) {
+		atomic.AddInt32(&calls, 1)
+		return nil, errors.New("refused")
+	})
+	time.Sleep(50 * time.Millisecond)
+	// one attempt per round, not size attempts
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Errorf("factories called %d times in the first round, want once each", n)
+	}
+	if _, ok := kp.Get("skip"); ok {
+		t.Error("Get returned a connection from a skipped pool")
+	}
+}
+
+func TestKeyedPoolRemoveDrains(t *testing.T) {
+	kp := NewKeyedPool(2, time.Minute)
+	var dials int32
+	kp.Set("a", pipeFactory(&dials))
+	waitFor(t, "the pool to fill", func() bool { return atomic.LoadInt32(&dials) == 2 })
+	kp.Remove("a")
+	if _, ok := kp.Get("a"); ok {
+		t.Error("Get returned a connection of a removed pool")
+	}
+
+	// replacing a pool drains the old one and fills the new one
+	var replaced int32
+	kp.Set("b", pipeFactory(&dials))
+	kp.Set("b", pipeFactory(&replaced))
+	waitFor(t, "the new pool to fill", func() bool { return atomic.LoadInt32(&replaced) == 2 })
+	kp.ReleaseAll()
+	if len(kp.Keys()) != 0 {
+		t.Errorf("Keys after ReleaseAll = %v", kp.Keys())
+	}
+}
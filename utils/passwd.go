@@ -0,0 +1,178 @@
+package utils
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Password schemes accepted in auth files, an entry without a scheme prefix is plaintext.
+//
+//	{SHA256}<base64 salt>$<base64 sha256(salt + password)>
+//	{PBKDF2}<iterations>$<base64 salt>$<base64 PBKDF2-HMAC-SHA256 key>
+const (
+	PasswordSchemeSHA256 = "{SHA256}"
+	PasswordSchemePBKDF2 = "{PBKDF2}"
+)
+
+const (
+	// PBKDF2Iterations is the iteration count for newly hashed passwords
+	PBKDF2Iterations = 10000
+	// PBKDF2SaltSize is the salt length in bytes for newly hashed passwords
+	PBKDF2SaltSize = 16
+)
+
+// PBKDF2 derives a keyLen bytes key from password and salt with HMAC-SHA256, as in RFC 8018
+func PBKDF2(password, salt []byte, iterations, keyLen int) []byte {
+	prf := hmac.New(sha256.New, password)
+	hashLen := prf.Size()
+	blocks := (keyLen + hashLen - 1) / hashLen
+	key := make([]byte, 0, blocks*hashLen)
+	var buf [4]byte
+	u := make([]byte, hashLen)
+	for block := 1; block <= blocks; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.BigEndian.PutUint32(buf[:], uint32(block))
+		prf.Write(buf[:])
+		key = prf.Sum(key)
+		t := key[len(key)-hashLen:]
+		copy(u, t)
+		for i := 1; i < iterations; i++ {
+			u = pbkdf2Round(prf, u)
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+	}
+	return key[:keyLen]
+}
+
+func pbkdf2Round(prf hash.Hash, u []byte) []byte {
+	prf.Reset()
+	prf.Write(u)
+	return prf.Sum(u[:0])
+}
+
+// HashPassword hashes pass with PBKDF2 and a fresh random salt
+func HashPassword(pass string) (salt, sum []byte, err error) {
+	salt = make([]byte, PBKDF2SaltSize)
+	if _, err = rand.Read(salt); err != nil {
+		return
+	}
+	sum = PBKDF2([]byte(pass), salt, PBKDF2Iterations, sha256.Size)
+	return
+}
+
+// CheckPasswordHash reports whether pass matches a PBKDF2 hash, in constant time
+func CheckPasswordHash(pass string, salt, sum []byte, iterations int) bool {
+	if len(sum) == 0 {
+		return false
+	}
+	return subtle.ConstantTimeCompare(PBKDF2([]byte(pass), salt, iterations, len(sum)), sum) == 1
+}
+
+// IsHashedPassword reports whether an auth file password uses a hash scheme
+func IsHashedPassword(stored string) bool {
+	return strings.HasPrefix(stored, PasswordSchemeSHA256) || strings.HasPrefix(stored, PasswordSchemePBKDF2)
+}
+
+// CheckPassword compares pass with a password from an auth file, hashed or plaintext,
+// in constant time. A malformed hash never matches.
+func CheckPassword(stored, pass string) bool {
+	switch {
+	case strings.HasPrefix(stored, PasswordSchemeSHA256):
+		parts := strings.Split(strings.TrimPrefix(stored, PasswordSchemeSHA256), "$")
+		if len(parts) != 2 {
+			return false
+		}
+		salt, err1 := base64.StdEncoding.DecodeString(parts[0])
+		sum, err2 := base64.StdEncoding.DecodeString(parts[1])
+		if err1 != nil || err2 != nil {
+			return false
+		}
+		actual := sha256.Sum256(append(salt, pass...))
+		return subtle.ConstantTimeCompare(actual[:], sum) == 1
+	case strings.HasPrefix(stored, PasswordSchemePBKDF2):
+		parts := strings.Split(strings.TrimPrefix(stored, PasswordSchemePBKDF2), "$")
+		if len(parts) != 3 {
+			return false
+		}
+		iterations, err := strconv.Atoi(parts[0])
+		if err != nil || iterations <= 0 {
+			return false
+		}
+		salt, err1 := base64.StdEncoding.DecodeString(parts[1])
+		sum, err2 := base64.StdEncoding.DecodeString(parts[2])
+		if err1 != nil || err2 != nil {
+			return false
+		}
+		return CheckPasswordHash(pass, salt, sum, iterations)
+	default:
+		return subtle.ConstantTimeCompare([]byte(stored), []byte(pass)) == 1
+	}
+}
+
+// HashPasswordEntry hashes pass with a fresh salt in the given scheme, for use in an auth file
+func HashPasswordEntry(pass, scheme string) (entry string, err error) {
+	switch strings.ToUpper(scheme) {
+	case PasswordSchemePBKDF2, "PBKDF2", "":
+		salt, sum, e := HashPassword(pass)
+		if e != nil {
+			return "", e
+		}
+		return fmt.Sprintf("%s%d$%s$%s", PasswordSchemePBKDF2, PBKDF2Iterations,
+			base64.StdEncoding.EncodeToString(salt), base64.StdEncoding.EncodeToString(sum)), nil
+	case PasswordSchemeSHA256, "SHA256":
+		salt := make([]byte, PBKDF2SaltSize)
+		if _, err = rand.Read(salt); err != nil {
+			return
+		}
+		sum := sha256.Sum256(append(salt, pass...))
+		return PasswordSchemeSHA256 + base64.StdEncoding.EncodeToString(salt) + "$" +
+			base64.StdEncoding.EncodeToString(sum[:]), nil
+	default:
+		return "", fmt.Errorf("unknown password scheme %s", scheme)
+	}
+}
+
+// Passwd implements the passwd subcommand, it prints an auth file line for a user.
+// args are the username and an optional scheme, pbkdf2 (default) or sha256.
+// The password is read from the first line of stdin so it never shows up in the process list.
+func Passwd(args []string) (err error) {
+	if len(args) < 1 || len(args) > 2 || strings.Contains(args[0], ":") {
+		fmt.Fprintln(os.Stderr, "usage: proxy passwd <username> [pbkdf2|sha256] < password")
+		return fmt.Errorf("invalid arguments")
+	}
+	scheme := ""
+	if len(args) == 2 {
+		scheme = args[1]
+	}
+	fmt.Fprint(os.Stderr, "password: ")
+	pass, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	fmt.Fprintln(os.Stderr)
+	pass = strings.TrimRight(pass, "\r\n")
+	if pass == "" {
+		if err == nil {
+			err = fmt.Errorf("empty password")
+		}
+		fmt.Fprintf(os.Stderr, "err:%s\n", err)
+		return
+	}
+	entry, err := HashPasswordEntry(pass, scheme)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "err:%s\n", err)
+		return
+	}
+	fmt.Printf("%s:%s\n", args[0], entry)
+	return nil
+}
@@ -0,0 +1,91 @@
+package utils
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+// PBKDF2-HMAC-SHA256 test vectors from RFC 7914 section 11
+func TestPBKDF2(t *testing.T) {
+	tests := []struct {
+		password, salt string
+		iterations     int
+		want           string
+	}{
+		{"passwd", "salt", 1,
+			"55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc" +
+				"49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783"},
+		{"Password", "NaCl", 80000,
+			"4ddcd8f60b98be21830cee5ef22701f9641a4418d04c0414aeff08876b34ab56" +
+				"a1d425a1225833549adb841b51c9b3176a272bdebba1d078478f62b397f33c8d"},
+	}
+	for _, tt := range tests {
+		key := PBKDF2([]byte(tt.password), []byte(tt.salt), tt.iterations, len(tt.want)/2)
+		if got := hex.EncodeToString(key); got != tt.want {
+			t.Errorf("PBKDF2(%q, %q, %d) = %s, want %s", tt.password, tt.salt, tt.iterations, got, tt.want)
+		}
+		// a key shorter than the hash size is a prefix of the longer one
+		if got := hex.EncodeToString(PBKDF2([]byte(tt.password), []byte(tt.salt), tt.iterations, 20)); got != tt.want[:40] {
+			t.Errorf("PBKDF2(%q, %q, %d) truncated = %s, want %s", tt.password, tt.salt, tt.iterations, got, tt.want[:40])
+		}
+	}
+}
+
+func TestHashPasswordEntry(t *testing.T) {
+	for _, scheme := range []string{"", "pbkdf2", "PBKDF2", "{PBKDF2}", "sha256", "{SHA256}"} {
+		entry, err := HashPasswordEntry("s3cret:pass", scheme)
+		if err != nil {
+			t.Fatalf("HashPasswordEntry(%q): %v", scheme, err)
+		}
+		if !IsHashedPassword(entry) {
+			t.Errorf("HashPasswordEntry(%q) = %q, not a hashed password", scheme, entry)
+		}
+		if want := strings.Trim(strings.ToUpper(scheme), "{}"); want != "" && !strings.HasPrefix(entry, "{"+want+"}") {
+			t.Errorf("HashPasswordEntry(%q) = %q, want the {%s} scheme", scheme, entry, want)
+		}
+		if !CheckPassword(entry, "s3cret:pass") {
+			t.Errorf("CheckPassword(%q) rejected the hashed password", entry)
+		}
+		if CheckPassword(entry, "s3cret:pas") {
+			t.Errorf("CheckPassword(%q) accepted a wrong password", entry)
+		}
+	}
+	if _, err := HashPasswordEntry("pass", "md5"); err == nil {
+		t.Error("HashPasswordEntry accepted an unknown scheme")
+	}
+	a, _ := HashPasswordEntry("pass", "")
+	b, _ := HashPasswordEntry("pass", "")
+	if a == b {
+		t.Error("HashPasswordEntry reused a salt")
+	}
+}
+
+func TestCheckPassword(t *testing.T) {
+	tests := []struct {
+		stored, pass string
+		want         bool
+	}{
+		{"plain", "plain", true},
+		{"plain", "Plain", false},
+		{"plain", "", false},
+		// sha256("salt" + "pass"), salt "salt"
+		{"{SHA256}c2FsdA==$nJW/kJzxe+qnpMcdhmcVZilGmamU23qqj/6gBPQllU8=", "pass", true},
+		{"{SHA256}c2FsdA==$nJW/kJzxe+qnpMcdhmcVZilGmamU23qqj/6gBPQllU8=", "pas", false},
+		// first vector of RFC 7914 section 11, truncated to 32 bytes
+		{"{PBKDF2}1$c2FsdA==$VawEblbjCJ/sFpHCJUS2BflBhSFt3gRl5oudV8INrLw=", "passwd", true},
+		{"{PBKDF2}1$c2FsdA==$VawEblbjCJ/sFpHCJUS2BflBhSFt3gRl5oudV8INrLw=", "Passwd", false},
+		// malformed hashes never match, not even their own text
+		{"{SHA256}c2FsdA==", "{SHA256}c2FsdA==", false},
+		{"{SHA256}!!$!!", "pass", false},
+		{"{PBKDF2}0$c2FsdA==$VawEblbjCJ/sFpHCJUS2BflBhSFt3gRl5oudV8INrLw=", "passwd", false},
+		{"{PBKDF2}x$c2FsdA==$VawEblbjCJ/sFpHCJUS2BflBhSFt3gRl5oudV8INrLw=", "passwd", false},
+		{"{PBKDF2}1$c2FsdA==$", "passwd", false},
+		{"{PBKDF2}1$c2FsdA==", "passwd", false},
+	}
+	for _, tt := range tests {
+		if got := CheckPassword(tt.stored, tt.pass); got != tt.want {
+			t.Errorf("CheckPassword(%q, %q) = %v, want %v", tt.stored, tt.pass, got, tt.want)
+		}
+	}
+}
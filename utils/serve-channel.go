@@ -13,6 +13,7 @@ type ServerChannel struct {
 	Listener         *net.Listener
 	UDPListener      *net.UDPConn
 	errAcceptHandler func(err error)
+	acceptFilter     func(conn net.Conn) bool
 }
 
 func NewServerChannel(ip string, port int) ServerChannel {
@@ -29,6 +30,21 @@ func (sc *ServerChannel) SetErrAcceptHandler(fn func(err error)) {
 	sc.errAcceptHandler = fn
 }
 
+// SetAcceptFilter sets a check run on every accepted connection before fn,
+// connections it returns false for are closed right away
+func (sc *ServerChannel) SetAcceptFilter(fn func(conn net.Conn) bool) {
+	sc.acceptFilter = fn
+}
+
+// accepted reports whether a new connection passes the accept filter, closing it if not
+func (sc *ServerChannel) accepted(conn net.Conn) bool {
+	if sc.acceptFilter == nil || sc.acceptFilter(conn) {
+		return true
+	}
+	conn.Close()
+	return false
+}
+
 func (sc *ServerChannel) ListenTls(certBytes, keyBytes []byte, fn func(conn net.Conn)) (err error) {
 	sc.Listener, err = ListenTls(sc.ip, sc.port, certBytes, keyBytes)
 	if err == nil {
@@ -42,6 +58,9 @@ func (sc *ServerChannel) ListenTls(certBytes, keyBytes []byte, fn func(conn net.
 				var conn net.Conn
 				conn, err = (*sc.Listener).Accept()
 				if err == nil {
+					if !sc.accepted(conn) {
+						continue
+					}
 					go func() {
 						defer func() {
 							if e := recover(); e != nil {
@@ -76,6 +95,9 @@ func (sc *ServerChannel) ListenTCP(fn func(conn net.Conn)) (err error) {
 				var conn net.Conn
 				conn, err = (*sc.Listener).Accept()
 				if err == nil {
+					if !sc.accepted(conn) {
+						continue
+					}
 					go func() {
 						defer func() {
 							if e := recover(); e != nil {
@@ -11,15 +11,24 @@ import (
 	"net/url"
 	"os"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
 type Checker struct {
-	data       ConcurrentMap
-	blockedMap ConcurrentMap
-	directMap  ConcurrentMap
-	interval   int64
-	timeout    int
+	data ConcurrentMap
+	// lists holds the current *domainLists, swapped as a whole when a file is reloaded
+	lists       *atomic.Value
+	blockedFile string
+	directFile  string
+	interval    int64
+	timeout     int
+}
+
+// domainLists are the domains loaded from the blocked and direct files
+type domainLists struct {
+	blocked ConcurrentMap
+	direct  ConcurrentMap
 }
 
 type CheckerItem struct {
@@ -38,22 +47,61 @@ type CheckerItem struct {
 // interval: recheck domain interval seconds
 func NewChecker(timeout int, interval int64, blockedFile, directFile string) Checker {
 	ch := Checker{
-		data:     NewConcurrentMap(),
-		interval: interval,
-		timeout:  timeout,
+		data:        NewConcurrentMap(),
+		lists:       &atomic.Value{},
+		blockedFile: blockedFile,
+		directFile:  directFile,
+		interval:    interval,
+		timeout:     timeout,
+	}
+	lists := &domainLists{
+		blocked: ch.loadMap(blockedFile),
+		direct:  ch.loadMap(directFile),
 	}
-	ch.blockedMap = ch.loadMap(blockedFile)
-	ch.directMap = ch.loadMap(directFile)
-	if !ch.blockedMap.IsEmpty() {
-		log.Printf("blocked file loaded , domains : %d", ch.blockedMap.Count())
+	ch.lists.Store(lists)
+	if !lists.blocked.IsEmpty() {
+		log.Printf("blocked file loaded , domains : %d", lists.blocked.Count())
 	}
-	if !ch.directMap.IsEmpty() {
-		log.Printf("direct file loaded , domains : %d", ch.directMap.Count())
+	if !lists.direct.IsEmpty() {
+		log.Printf("direct file loaded , domains : %d", lists.direct.Count())
 	}
 	ch.start()
 	return ch
 }
 
+// ReloadBlocked reads the blocked file again and swaps in its domains
+func (c *Checker) ReloadBlocked() {
+	old := c.lists.Load().(*domainLists)
+	blocked := c.loadMap(c.blockedFile)
+	c.lists.Store(&domainLists{blocked: blocked, direct: old.direct})
+	added, removed := diffKeys(old.blocked, blocked)
+	log.Printf("blocked file reloaded , domains : %d, added : %d, removed : %d", blocked.Count(), added, removed)
+}
+
+// ReloadDirect reads the direct file again and swaps in its domains
+func (c *Checker) ReloadDirect() {
+	old := c.lists.Load().(*domainLists)
+	direct := c.loadMap(c.directFile)
+	c.lists.Store(&domainLists{blocked: old.blocked, direct: direct})
+	added, removed := diffKeys(old.direct, direct)
+	log.Printf("direct file reloaded , domains : %d, added : %d, removed : %d", direct.Count(), added, removed)
+}
+
+// diffKeys counts the keys of next that are not in prev and the keys of prev missing in next
+func diffKeys(prev, next ConcurrentMap) (added, removed int) {
+	for _, key := range next.Keys() {
+		if !prev.Has(key) {
+			added++
+		}
+	}
+	for _, key := range prev.Keys() {
+		if !next.Has(key) {
+			removed++
+		}
+	}
+	return
+}
+
 func (c *Checker) loadMap(f string) (dataMap ConcurrentMap) {
 	dataMap = NewConcurrentMap()
 	if PathExists(f) {
@@ -142,12 +190,13 @@ func (c *Checker) domainIsInMap(address string, blockedMap bool) bool {
 		subSlice := domainSlice[:len(domainSlice)-1]
 		topDomain := strings.Join(domainSlice[len(domainSlice)-1:], ".")
 		checkDomain := topDomain
+		lists := c.lists.Load().(*domainLists)
 		for i := len(subSlice) - 1; i >= 0; i-- {
 			checkDomain = subSlice[i] + "." + checkDomain
-			if !blockedMap && c.directMap.Has(checkDomain) {
+			if !blockedMap && lists.direct.Has(checkDomain) {
 				return true
 			}
-			if blockedMap && c.blockedMap.Has(checkDomain) {
+			if blockedMap && lists.blocked.Has(checkDomain) {
 				return true
 			}
 		}
@@ -175,39 +224,120 @@ func (c *Checker) Add(address string, isHTTPS bool, method, URL string, data []b
 }
 
 type BasicAuth struct {
-	data      ConcurrentMap
-	Validator func(string, string) bool
+	// data holds the current ConcurrentMap of username to password, swapped as a whole when
+	// the auth file is reloaded
+	data *atomic.Value
+	// static are the --auth entries, kept across auth file reloads
+	static []string
+	// Validator checks credentials not in the auth file, err is set when it could not decide,
+	// e.g. Captain timed out, and the result is then not cached
+	Validator func(user, pass string) (ok bool, err error)
+	// Authorizer, when set, decides whether an authenticated user may connect from an ip
+	Authorizer func(user, ip string) error
+	// Cache holds the results of Validator, nil means Validator runs for every check
+	Cache *AuthCache
+	// IPList authenticates clients that send no credentials by source ip, e.g. from --ip-auth-file
+	IPList *IPAuthList
+	// IPAuthenticator, when set, is asked for sources not in IPList
+	IPAuthenticator func(ip string) (user string, ok bool)
+	// Guard bans sources and usernames with too many failed logins, nil disables bans
+	Guard *AuthGuard
 }
 
 func NewBasicAuth() BasicAuth {
+	data := &atomic.Value{}
+	data.Store(NewConcurrentMap())
 	return BasicAuth{
-		data: NewConcurrentMap(),
+		data: data,
 	}
 }
+
+func (ba *BasicAuth) users() ConcurrentMap {
+	return ba.data.Load().(ConcurrentMap)
+}
+
+// AddFromFile loads "username:password" lines, passwords may be hashed, see CheckPassword
 func (ba *BasicAuth) AddFromFile(file string) (n int, err error) {
+	entries, err := readAuthFile(file)
+	if err != nil {
+		return
+	}
+	users := ba.users()
+	for user, pass := range entries {
+		users.Set(user, pass)
+		n++
+	}
+	return
+}
+
+// ReloadFile replaces the users loaded from file with its current contents,
+// users added with Add are kept
+func (ba *BasicAuth) ReloadFile(file string) (added, removed, changed int, err error) {
+	entries, err := readAuthFile(file)
+	if err != nil {
+		return
+	}
+	users := NewConcurrentMap()
+	for user, pass := range entries {
+		users.Set(user, pass)
+	}
+	addEntries(users, ba.static)
+
+	old := ba.users()
+	for _, user := range users.Keys() {
+		if p, ok := old.Get(user); !ok {
+			added++
+		} else if v, _ := users.Get(user); p.(string) != v.(string) {
+			changed++
+		}
+	}
+	for _, user := range old.Keys() {
+		if !users.Has(user) {
+			removed++
+		}
+	}
+	ba.data.Store(users)
+	return
+}
+
+// readAuthFile parses an auth file, warning about plaintext passwords
+func readAuthFile(file string) (entries map[string]string, err error) {
 	_content, err := os.ReadFile(file)
 	if err != nil {
 		return
 	}
+	entries = make(map[string]string)
 	userpassArr := strings.Split(strings.Replace(string(_content), "\r", "", -1), "\n")
+	plain := 0
 	for _, userpass := range userpassArr {
-		if strings.HasPrefix("#", userpass) {
+		userpass = strings.Trim(userpass, " ")
+		if userpass == "" || strings.HasPrefix(userpass, "#") {
 			continue
 		}
-		u := strings.Split(strings.Trim(userpass, " "), ":")
+		u := strings.SplitN(userpass, ":", 2)
 		if len(u) == 2 {
-			ba.data.Set(u[0], u[1])
-			n++
+			entries[u[0]] = u[1]
+			if !IsHashedPassword(u[1]) {
+				plain++
+			}
 		}
 	}
+	if plain > 0 {
+		log.Printf("WARN: auth file %s has %d plaintext passwords, hash them with: proxy passwd <username>", file, plain)
+	}
 	return
 }
 
 func (ba *BasicAuth) Add(userpassArr []string) (n int) {
+	ba.static = append(ba.static, userpassArr...)
+	return addEntries(ba.users(), userpassArr)
+}
+
+func addEntries(users ConcurrentMap, userpassArr []string) (n int) {
 	for _, userpass := range userpassArr {
-		u := strings.Split(userpass, ":")
+		u := strings.SplitN(userpass, ":", 2)
 		if len(u) == 2 {
-			ba.data.Set(u[0], u[1])
+			users.Set(u[0], u[1])
 			n++
 		}
 	}
@@ -216,25 +346,67 @@ func (ba *BasicAuth) Add(userpassArr []string) (n int) {
 
 // check in basic auth and if not check in the captain
 func (ba *BasicAuth) Check(userpass string) (ok bool) {
-	u := strings.Split(strings.Trim(userpass, " "), ":")
+	ok, _ = ba.check(userpass)
+	return
+}
+
+// check is Check, err is set when the Validator could not decide
+func (ba *BasicAuth) check(userpass string) (ok bool, err error) {
+	u := strings.SplitN(strings.Trim(userpass, " "), ":", 2)
 	if len(u) == 2 {
-		if p, _ok := ba.data.Get(u[0]); _ok {
-			log.Printf("basic auth check , user:%s pass:%s", u[0], u[1])
-			return p.(string) == u[1]
+		if p, _ok := ba.users().Get(u[0]); _ok {
+			return CheckPassword(p.(string), u[1]), nil
 		}
 		if ba.Validator != nil {
-			isValid := ba.Validator(u[0], u[1])
-			if isValid {
-				ba.data.Set(u[0], u[1])
+			if isValid, found := ba.Cache.Get(u[0], u[1]); found {
+				return isValid, nil
 			}
-			return isValid
+			isValid, err := ba.Validator(u[0], u[1])
+			if err == nil {
+				ba.Cache.Set(u[0], u[1], isValid)
+			}
+			return isValid, err
 		}
 	}
 	return
 }
 
+// CheckFrom is Check for a client at ip, banned clients and usernames are refused without
+// checking. Only credentials that were actually rejected count towards a ban, not checks
+// the Validator could not decide.
+func (ba *BasicAuth) CheckFrom(userpass, ip string) (ok bool) {
+	user := strings.SplitN(strings.Trim(userpass, " "), ":", 2)[0]
+	if ba.Guard.Banned(ip) || ba.Guard.UserBanned(user) {
+		return false
+	}
+	ok, err := ba.check(userpass)
+	if !ok && err == nil {
+		ba.Guard.RecordFailure(ip, user)
+	}
+	return
+}
+
+// AuthenticateIP returns the user a client without credentials is authenticated as by its source ip
+func (ba *BasicAuth) AuthenticateIP(ip string) (user string, ok bool) {
+	if user, ok = ba.IPList.Lookup(ip); ok {
+		return
+	}
+	if ba.IPAuthenticator != nil {
+		return ba.IPAuthenticator(ip)
+	}
+	return
+}
+
+// Authorize runs the Authorizer for a user that passed Check
+func (ba *BasicAuth) Authorize(user, ip string) (err error) {
+	if ba.Authorizer != nil {
+		err = ba.Authorizer(user, ip)
+	}
+	return
+}
+
 func (ba *BasicAuth) Total() (n int) {
-	n = ba.data.Count()
+	n = ba.users().Count()
 	return
 }
 
@@ -247,6 +419,8 @@ type HTTPRequest struct {
 	hostOrURL   string
 	isBasicAuth bool
 	basicAuth   *BasicAuth
+	// User is the authenticated user and the parameters from its username
+	User UserParams
 }
 
 func NewHTTPRequest(inConn *net.Conn, bufSize int, isBasicAuth bool, basicAuth *BasicAuth) (req HTTPRequest, err error) {
@@ -328,8 +502,15 @@ func (req *HTTPRequest) IsHTTPS() bool {
 func (req *HTTPRequest) BasicAuth() (err error) {
 
 	//log.Printf("request :%s", string(b[:n]))
+	clientIP, _, _ := net.SplitHostPort((*req.conn).RemoteAddr().String())
 	authorization, err := req.getHeader("Proxy-Authorization")
 	if err != nil {
+		// clients of ip authenticated users send no credentials
+		if ipUser, ok := (*req.basicAuth).AuthenticateIP(clientIP); ok {
+			req.User = UserParams{Username: ipUser}
+			err = req.authorize(clientIP)
+			return
+		}
 		fmt.Fprint((*req.conn),
 			"HTTP/1.1 407 Proxy Authentication Required\r\n"+
 				"Proxy-Authenticate: Basic realm=\"Proxy\"\r\n"+
@@ -352,7 +533,14 @@ func (req *HTTPRequest) BasicAuth() (err error) {
 		return
 	}
 
-	authOk := (*req.basicAuth).Check(string(user))
+	// authenticate the base username, the rest of it carries session parameters
+	userpass := strings.SplitN(string(user), ":", 2)
+	if len(userpass) == 2 {
+		req.User = ParseUserParams(userpass[0])
+		user = []byte(req.User.Username + ":" + userpass[1])
+	}
+
+	authOk := (*req.basicAuth).CheckFrom(string(user), clientIP)
 
 	//log.Printf("auth %s,%v", string(user), authOk)
 	if !authOk {
@@ -361,6 +549,17 @@ func (req *HTTPRequest) BasicAuth() (err error) {
 		err = fmt.Errorf("basic auth fail")
 		return
 	}
+
+	return req.authorize(clientIP)
+}
+
+// authorize checks that the authenticated user may connect from clientIP, answering 403 if not
+func (req *HTTPRequest) authorize(clientIP string) (err error) {
+	if authErr := (*req.basicAuth).Authorize(req.User.Username, clientIP); authErr != nil {
+		fmt.Fprintf((*req.conn), "HTTP/1.1 403 Forbidden\r\nContent-Length: %d\r\n\r\n%s", len(authErr.Error()), authErr)
+		CloseConn(req.conn)
+		err = fmt.Errorf("basic auth user %s refused: %s", req.User.Username, authErr)
+	}
 	return
 }
 func (req *HTTPRequest) getHTTPURL() (URL string, err error) {
@@ -420,10 +619,10 @@ func (req *HTTPRequest) GetBasicAuthUser() string {
 	if err != nil {
 		return ""
 	}
-	// user is in format "username:password"
+	// user is in format "username:password", the username may carry session parameters
 	parts := strings.SplitN(string(user), ":", 2)
 	if len(parts) >= 1 {
-		return parts[0]
+		return ParseUserParams(parts[0]).Username
 	}
 	return ""
 }
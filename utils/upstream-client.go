@@ -0,0 +1,244 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxConnectResponseSize limits how much of a CONNECT response header is read
+const maxConnectResponseSize = 8192
+
+// TargetRefusedError is returned when an upstream proxy answered the handshake but could not
+// reach the target, e.g. a CONNECT reply of 502 or a SOCKS5 reply of host unreachable.
+// The upstream itself is working.
+type TargetRefusedError struct {
+	Target string
+	// StatusLine is the CONNECT reply of an HTTP upstream, StatusCode its code
+	StatusLine string
+	StatusCode int
+	// Reply is the reply code of a SOCKS5 upstream
+	Reply byte
+}
+
+func (e *TargetRefusedError) Error() string {
+	if e.StatusCode != 0 {
+		return fmt.Sprintf("CONNECT %s refused: %s", e.Target, e.StatusLine)
+	}
+	return fmt.Sprintf("socks5 connect to %s failed, reply code: %d", e.Target, e.Reply)
+}
+
+// HTTPStatus returns the status line to answer an HTTP client with
+func (e *TargetRefusedError) HTTPStatus() string {
+	if e.StatusCode != 0 {
+		return strings.TrimPrefix(e.StatusLine, strings.Fields(e.StatusLine)[0]+" ")
+	}
+	switch e.Reply {
+	case 0x02:
+		return "403 Forbidden"
+	case 0x06:
+		return "504 Gateway Timeout"
+	}
+	return "502 Bad Gateway"
+}
+
+// SocksReply returns the SOCKS5 reply code to answer a SOCKS5 client with
+func (e *TargetRefusedError) SocksReply() byte {
+	if e.StatusCode == 0 {
+		return e.Reply
+	}
+	switch e.StatusCode {
+	case 403:
+		return 0x02
+	case 504:
+		return 0x06
+	}
+	return 0x04
+}
+
+// IsTargetRefused returns the TargetRefusedError in err's chain
+func IsTargetRefused(err error) (refused *TargetRefusedError, ok bool) {
+	ok = errors.As(err, &refused)
+	return
+}
+
+// TlsDialHost connects to hostAndPort and completes a TLS handshake verified against the host name,
+// used for upstream proxies that speak HTTP over TLS
+func TlsDialHost(hostAndPort string, timeout int) (conn net.Conn, err error) {
+	host, _, err := net.SplitHostPort(hostAndPort)
+	if err != nil {
+		return
+	}
+	_conn, err := ConnectHost(hostAndPort, timeout)
+	if err != nil {
+		return
+	}
+	tlsConn := tls.Client(_conn, &tls.Config{ServerName: host})
+	tlsConn.SetDeadline(time.Now().Add(time.Duration(timeout) * time.Millisecond))
+	if err = tlsConn.Handshake(); err != nil {
+		_conn.Close()
+		return
+	}
+	tlsConn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
+
+// HTTPConnect asks the HTTP proxy on conn to open a tunnel to target with a CONNECT request,
+// sending basic credentials when user is not empty
+func HTTPConnect(conn net.Conn, target, user, pass string, timeout int) (err error) {
+	conn.SetDeadline(time.Now().Add(time.Duration(timeout) * time.Millisecond))
+	defer conn.SetDeadline(time.Time{})
+
+	var req bytes.Buffer
+	fmt.Fprintf(&req, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n", target, target)
+	if user != "" {
+		token := base64.StdEncoding.EncodeToString([]byte(user + ":" + pass))
+		fmt.Fprintf(&req, "Proxy-Authorization: Basic %s\r\n", token)
+	}
+	req.WriteString("\r\n")
+	if _, err = conn.Write(req.Bytes()); err != nil {
+		return
+	}
+
+	// read byte by byte so no tunneled data is consumed after the header
+	head := make([]byte, 0, 512)
+	one := make([]byte, 1)
+	for !bytes.HasSuffix(head, []byte("\r\n\r\n")) {
+		if len(head) >= maxConnectResponseSize {
+			return fmt.Errorf("CONNECT response header too large")
+		}
+		if _, err = io.ReadFull(conn, one); err != nil {
+			return fmt.Errorf("read CONNECT response err:%s", err)
+		}
+		head = append(head, one[0])
+	}
+	statusLine := string(head[:bytes.IndexByte(head, '\n')])
+	fields := strings.Fields(statusLine)
+	if len(fields) < 2 || !strings.HasPrefix(fields[0], "HTTP/") {
+		return fmt.Errorf("malformed CONNECT response: %s", strings.TrimSpace(statusLine))
+	}
+	switch fields[1] {
+	case "200":
+	case "407":
+		// our credentials were refused, the upstream is not usable
+		return fmt.Errorf("CONNECT %s proxy authentication failed: %s", target, strings.TrimSpace(statusLine))
+	default:
+		code, _ := strconv.Atoi(fields[1])
+		if code == 0 {
+			return fmt.Errorf("malformed CONNECT response: %s", strings.TrimSpace(statusLine))
+		}
+		return &TargetRefusedError{Target: target, StatusLine: strings.TrimSpace(statusLine), StatusCode: code}
+	}
+	return
+}
+
+// Socks5Connect runs a SOCKS5 client handshake on conn and asks the server to connect to target.
+// Username/password authentication (RFC 1929) is offered when user is not empty
+func Socks5Connect(conn net.Conn, target, user, pass string, timeout int) (err error) {
+	conn.SetDeadline(time.Now().Add(time.Duration(timeout) * time.Millisecond))
+	defer conn.SetDeadline(time.Time{})
+
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port <= 0 || port > 65535 {
+		return fmt.Errorf("invalid port in %s", target)
+	}
+
+	// greeting: VER, NMETHODS, METHODS
+	method := byte(0x00)
+	if user != "" {
+		method = 0x02
+	}
+	if _, err = conn.Write([]byte{0x05, 0x01, method}); err != nil {
+		return
+	}
+	reply := make([]byte, 2)
+	if _, err = io.ReadFull(conn, reply); err != nil {
+		return fmt.Errorf("read socks5 method reply err:%s", err)
+	}
+	if reply[0] != 0x05 || reply[1] != method {
+		return fmt.Errorf("socks5 server rejected auth method %d", method)
+	}
+
+	if method == 0x02 {
+		if len(user) > 255 || len(pass) > 255 {
+			return fmt.Errorf("socks5 username or password too long")
+		}
+		auth := []byte{0x01, byte(len(user))}
+		auth = append(auth, user...)
+		auth = append(auth, byte(len(pass)))
+		auth = append(auth, pass...)
+		if _, err = conn.Write(auth); err != nil {
+			return
+		}
+		if _, err = io.ReadFull(conn, reply); err != nil {
+			return fmt.Errorf("read socks5 auth reply err:%s", err)
+		}
+		if reply[1] != 0x00 {
+			return fmt.Errorf("socks5 authentication failed for user %s", user)
+		}
+	}
+
+	// request: VER, CMD, RSV, ATYP, DST.ADDR, DST.PORT
+	request := []byte{0x05, 0x01, 0x00}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			request = append(request, 0x01)
+			request = append(request, ip4...)
+		} else {
+			request = append(request, 0x04)
+			request = append(request, ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return fmt.Errorf("socks5 domain too long: %s", host)
+		}
+		request = append(request, 0x03, byte(len(host)))
+		request = append(request, host...)
+	}
+	portBytes := make([]byte, 2)
+	binary.BigEndian.PutUint16(portBytes, uint16(port))
+	request = append(request, portBytes...)
+	if _, err = conn.Write(request); err != nil {
+		return
+	}
+
+	// reply: VER, REP, RSV, ATYP, BND.ADDR, BND.PORT
+	header := make([]byte, 4)
+	if _, err = io.ReadFull(conn, header); err != nil {
+		return fmt.Errorf("read socks5 reply err:%s", err)
+	}
+	if header[0] != 0x05 {
+		return fmt.Errorf("socks5 reply has bad version: %d", header[0])
+	}
+	if header[1] != 0x00 {
+		return &TargetRefusedError{Target: target, Reply: header[1]}
+	}
+	var addrLen int
+	switch header[3] {
+	case 0x01:
+		addrLen = 4
+	case 0x04:
+		addrLen = 16
+	case 0x03:
+		if _, err = io.ReadFull(conn, reply[:1]); err != nil {
+			return
+		}
+		addrLen = int(reply[0])
+	default:
+		return fmt.Errorf("socks5 reply has unknown address type: %d", header[3])
+	}
+	_, err = io.ReadFull(conn, make([]byte, addrLen+2))
+	return
+}
@@ -0,0 +1,79 @@
+package utils
+
+import (
+	"strconv"
+	"strings"
+)
+
+// UserParams holds the options a client encodes in its proxy username,
+// e.g. alice-country-us-session-abc123-sesstime-10 authenticates as alice and asks for
+// an upstream in the US, pinned by sticky session abc123 for 10 idle minutes.
+type UserParams struct {
+	// Username is the base username used for authentication
+	Username string
+	// Session is the sticky session token, empty when no session was requested
+	Session string
+	// SessionTime is the session lifetime in minutes, zero means the default
+	SessionTime int
+	// Country, Tag and Provider restrict the upstreams that may be selected, empty means any
+	Country  string
+	Tag      string
+	Provider string
+}
+
+var userParamKeys = map[string]bool{
+	"session":  true,
+	"sesstime": true,
+	"country":  true,
+	"tag":      true,
+	"provider": true,
+}
+
+// ParseUserParams splits a proxy username into the base username and its parameters.
+// Parameters are "-key-value" pairs following the base username, a username whose
+// suffix is not a valid list of pairs is returned unchanged as the base username.
+func ParseUserParams(raw string) (params UserParams) {
+	params.Username = raw
+	tokens := strings.Split(raw, "-")
+	start := -1
+	for i := 1; i < len(tokens); i++ {
+		if userParamKeys[strings.ToLower(tokens[i])] {
+			start = i
+			break
+		}
+	}
+	if start == -1 || (len(tokens)-start)%2 != 0 {
+		return
+	}
+	parsed := UserParams{Username: strings.Join(tokens[:start], "-")}
+	for i := start; i < len(tokens); i += 2 {
+		key, value := strings.ToLower(tokens[i]), tokens[i+1]
+		if value == "" {
+			return
+		}
+		switch key {
+		case "session":
+			parsed.Session = value
+		case "sesstime":
+			minutes, err := strconv.Atoi(value)
+			if err != nil || minutes <= 0 {
+				return
+			}
+			parsed.SessionTime = minutes
+		case "country":
+			parsed.Country = value
+		case "tag":
+			parsed.Tag = value
+		case "provider":
+			parsed.Provider = value
+		default:
+			return
+		}
+	}
+	return parsed
+}
+
+// HasTargeting reports whether the user restricted the upstreams that may be selected
+func (p UserParams) HasTargeting() bool {
+	return p.Country != "" || p.Tag != "" || p.Provider != ""
+}
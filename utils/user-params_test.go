@@ -0,0 +1,43 @@
+package utils
+
+import "testing"
+
+func TestParseUserParams(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want UserParams
+	}{
+		{"alice", UserParams{Username: "alice"}},
+		{"alice-session-abc123", UserParams{Username: "alice", Session: "abc123"}},
+		{"alice-session-abc123-sesstime-10", UserParams{Username: "alice", Session: "abc123", SessionTime: 10}},
+		{"alice-SESSION-abc123", UserParams{Username: "alice", Session: "abc123"}},
+		{"alice-country-us-tag-dc-provider-acme", UserParams{Username: "alice", Country: "us", Tag: "dc", Provider: "acme"}},
+		// dashes in the base username are kept up to the first known key
+		{"mary-jane-session-x", UserParams{Username: "mary-jane", Session: "x"}},
+		// a key as the whole username is not a parameter
+		{"session-abc", UserParams{Username: "session-abc"}},
+		// anything that is not a valid list of pairs leaves the username unchanged
+		{"alice-session", UserParams{Username: "alice-session"}},
+		{"alice-session-", UserParams{Username: "alice-session-"}},
+		{"alice-session-x-color-red", UserParams{Username: "alice-session-x-color-red"}},
+		{"alice-session-x-sesstime-ten", UserParams{Username: "alice-session-x-sesstime-ten"}},
+		{"alice-sesstime-0", UserParams{Username: "alice-sesstime-0"}},
+		{"alice-sesstime--5", UserParams{Username: "alice-sesstime--5"}},
+	}
+	for _, tt := range tests {
+		if got := ParseUserParams(tt.raw); got != tt.want {
+			t.Errorf("ParseUserParams(%q) = %+v, want %+v", tt.raw, got, tt.want)
+		}
+	}
+}
+
+func TestUserParamsHasTargeting(t *testing.T) {
+	if ParseUserParams("alice-session-x").HasTargeting() {
+		t.Error("a session alone is not targeting")
+	}
+	for _, raw := range []string{"alice-country-us", "alice-tag-dc", "alice-provider-acme"} {
+		if !ParseUserParams(raw).HasTargeting() {
+			t.Errorf("%q has no targeting", raw)
+		}
+	}
+}